@@ -0,0 +1,48 @@
+package gomemcache
+
+import (
+	"sync"
+	"time"
+)
+
+// FlushAll invalidate all items of every server after delay, zero delay
+// invalidates them at once and negative delay returns ErrInvalidExpiration.
+// Servers failed are returned as ServerErrors.
+func (client *Client) FlushAll(delay time.Duration) error {
+	if delay < 0 {
+		return ErrInvalidExpiration
+	}
+	expiration := expirationOf(delay)
+	if client.near != nil {
+		client.near.clear()
+	}
+	return client.eachServer(func(index int, server string) error {
+		return client.protocol.flushAll(index, expiration)
+	})
+}
+
+// Version return the version of every server keyed by server address,
+// versions of servers which respond are returned with ServerErrors of the others.
+func (client *Client) Version() (map[string]string, error) {
+	var mu sync.Mutex
+	versions := make(map[string]string, len(client.servers))
+	err := client.eachServer(func(index int, server string) error {
+		version, err := client.protocol.version(index)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		versions[server] = version
+		mu.Unlock()
+		return nil
+	})
+	return versions, err
+}
+
+// Ping check every server responds, it sends noop in binary protocol and
+// version in text protocol. Servers failed are returned as ServerErrors.
+func (client *Client) Ping() error {
+	return client.eachServer(func(index int, server string) error {
+		return client.protocol.noop(index)
+	})
+}
@@ -0,0 +1,45 @@
+package gomemcache
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	// ErrAuthFailed indicates the server rejected the credentials set by SetAuth
+	ErrAuthFailed = errors.New("authentication failed")
+	// errAuthContinue the server expects another SASL step
+	errAuthContinue = errors.New("authentication continue")
+)
+
+// credentials set by SetAuth
+type credentials struct {
+	username string
+	password string
+}
+
+// SetAuth authenticate every new connection with username and password,
+// binary protocol uses SASL PLAIN mechanism, text and meta protocol send
+// the credentials by set as memcached -Y auth file mode expects. It should
+// be called before sending any request, connections opened before aren't
+// authenticated.
+func (client *Client) SetAuth(username, password string) {
+	client.auth = &credentials{username: username, password: password}
+}
+
+// authenticate authenticate the new connection of protocol if credentials
+// are set, the handshake must complete in timeout.
+func (client *Client) authenticate(protocol string, conn net.Conn, timeout time.Duration) error {
+	auth := client.auth
+	if auth == nil {
+		return nil
+	}
+	if err := conn.SetDeadline(nowFunc().Add(timeout)); err != nil {
+		return err
+	}
+	if protocol == "binary" {
+		return saslAuth(conn, auth.username, auth.password)
+	}
+	return textAuth(conn, auth.username, auth.password)
+}
@@ -0,0 +1,110 @@
+package gomemcache
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultBatchKeys = 100
+
+type batchResult struct {
+	item *Item
+	err  error
+}
+
+// batcher coalesce concurrent single key gets into one multi get
+type batcher struct {
+	window  time.Duration
+	maxKeys int
+	fetch   func(keys []string) ([]*Item, error)
+
+	mu      sync.Mutex
+	keys    []string
+	waiters map[string][]chan batchResult
+	timer   *time.Timer
+}
+
+func newBatcher(window time.Duration, maxKeys int, fetch func(keys []string) ([]*Item, error)) *batcher {
+	if maxKeys <= 0 {
+		maxKeys = defaultBatchKeys
+	}
+	return &batcher{
+		window:  window,
+		maxKeys: maxKeys,
+		fetch:   fetch,
+		waiters: make(map[string][]chan batchResult),
+	}
+}
+
+// get queue the key into current batch and wait for the result
+func (b *batcher) get(key string) (*Item, error) {
+	ch := make(chan batchResult, 1)
+	b.mu.Lock()
+	if _, ok := b.waiters[key]; !ok {
+		b.keys = append(b.keys, key)
+	}
+	b.waiters[key] = append(b.waiters[key], ch)
+	if len(b.keys) >= b.maxKeys {
+		keys, waiters := b.take()
+		b.mu.Unlock()
+		b.send(keys, waiters)
+	} else {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.window, b.flush)
+		}
+		b.mu.Unlock()
+	}
+	result := <-ch
+	return result.item, result.err
+}
+
+// take detach the pending batch, it must be called with lock held
+func (b *batcher) take() ([]string, map[string][]chan batchResult) {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	keys, waiters := b.keys, b.waiters
+	b.keys = nil
+	b.waiters = make(map[string][]chan batchResult)
+	return keys, waiters
+}
+
+func (b *batcher) flush() {
+	b.mu.Lock()
+	if len(b.keys) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	keys, waiters := b.take()
+	b.mu.Unlock()
+	b.send(keys, waiters)
+}
+
+// send fetch the batch and spread results to waiters, keys not returned
+// get the fetch error which is nil on a miss.
+func (b *batcher) send(keys []string, waiters map[string][]chan batchResult) {
+	items, err := b.fetch(keys)
+	found := make(map[string]*Item, len(items))
+	for _, item := range items {
+		found[item.Key] = item
+	}
+	for key, chs := range waiters {
+		item, ok := found[key]
+		for i, ch := range chs {
+			if !ok {
+				ch <- batchResult{err: err}
+				continue
+			}
+			if i < len(chs)-1 {
+				// every caller owns its item, the last one gets the fetched item
+				// since it must not be read after it's sent
+				cp := *item
+				cp.Value = append([]byte(nil), item.Value...)
+				ch <- batchResult{item: &cp}
+				continue
+			}
+			ch <- batchResult{item: item}
+		}
+	}
+}
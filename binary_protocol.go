@@ -9,8 +9,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -21,6 +24,9 @@ const (
 var (
 	hdrSize = binary.Size(header{})
 
+	// opaqueCounter numbers requests so that replies of former requests are skipped
+	opaqueCounter uint32
+
 	errorMap = map[uint16]error{
 		0x001: ErrItemNotFound,
 		0x002: ErrItemExists,
@@ -29,8 +35,10 @@ var (
 		0x005: ErrItemNotStored,
 		0x006: errors.New("Incr/Decr on non-numeric value"),
 		0x007: errors.New("The vbucket belongs to another server"),
-		0x008: errors.New("Authentication error"),
-		0x009: errors.New("Authentication continue"),
+		0x008: ErrAuthFailed,
+		0x009: errAuthContinue,
+		0x020: ErrAuthFailed,
+		0x021: errAuthContinue,
 		0x081: errors.New("Unknown command"),
 		0x082: errors.New("Out of memory"),
 		0x083: errors.New("Not supported"),
@@ -67,6 +75,9 @@ var (
 		"flushq":     {opcode: 0x18, command: "flush", quiet: true, withKey: false},
 		"appendq":    {opcode: 0x19, command: "append", quiet: true, withKey: false},
 		"prependq":   {opcode: 0x1a, command: "prepend", quiet: true, withKey: false},
+		"saslList":   {opcode: 0x20, command: "sasl_list_mechs", quiet: false, withKey: false},
+		"saslAuth":   {opcode: 0x21, command: "sasl_auth", quiet: false, withKey: false},
+		"saslStep":   {opcode: 0x22, command: "sasl_step", quiet: false, withKey: false},
 		"cas":        {opcode: 0x01, command: "cas", quiet: false, withKey: false},
 		// memcached binary protocol doesn't define this operation (cas)
 	}
@@ -101,6 +112,9 @@ func (hdr *header) read(reader io.Reader) error {
 	if n, err := io.ReadFull(reader, hdrBuf); err != nil || n != hdrSize {
 		return err
 	}
+	if hdrBuf[0] != responseMagic {
+		return ErrInvalidResponseFormat
+	}
 	hdr.magic = hdrBuf[0]
 	hdr.opcode = hdrBuf[1]
 	hdr.keyLength = binary.BigEndian.Uint16(hdrBuf[2:4])
@@ -146,16 +160,25 @@ func (pkt *packet) write(writer io.Writer) error {
 	return err
 }
 
-func (pkt *packet) read(reader io.Reader) error {
+// readInto read the packet into buf if it's large enough, otherwise
+// a new buffer is allocated. It returns the buffer holding the body.
+func (pkt *packet) readInto(reader io.Reader, buf []byte) ([]byte, error) {
 	if err := pkt.header.read(reader); err != nil {
-		return err
+		return buf, err
 	}
 	// if err := binary.Read(reader, binary.BigEndian, &pkt.header); err != nil {
 	// return err
 	// }
-	body := make([]byte, pkt.bodyLength)
+	var body []byte
+	if uint32(cap(buf)) < pkt.bodyLength {
+		body = make([]byte, pkt.bodyLength)
+	} else {
+		body = buf[:pkt.bodyLength]
+	}
 	if n, err := io.ReadFull(reader, body); err != nil || uint32(n) != pkt.bodyLength {
-		return err
+		// status is only kept for complete packets
+		pkt.status = 0
+		return body, err
 	}
 	keyOffset := uint16(pkt.extrasLength) + pkt.keyLength
 	if pkt.keyLength != 0 {
@@ -168,13 +191,30 @@ func (pkt *packet) read(reader io.Reader) error {
 		pkt.extras = body[:pkt.extrasLength]
 	}
 	if pkt.status == 0 {
-		return nil
+		return body, nil
 	}
 	e, ok := errorMap[pkt.status]
 	if ok {
-		return e
+		return body, e
 	}
-	return fmt.Errorf("server response status code error: %d", pkt.status)
+	return body, fmt.Errorf("server response status code error: %d", pkt.status)
+}
+
+// readReply read the reply of the request numbered opaque, replies of
+// other requests, such as errors of quiet requests before, are skipped.
+// A failed read returns with status 0.
+func (pkt *packet) readReply(reader io.Reader, buf []byte, opaque uint32) ([]byte, error) {
+	for {
+		*pkt = packet{}
+		body, err := pkt.readInto(reader, buf)
+		if pkt.opaque == opaque || (err != nil && pkt.status == 0) {
+			return body, err
+		}
+	}
+}
+
+func nextOpaque() uint32 {
+	return atomic.AddUint32(&opaqueCounter, 1)
 }
 
 // BinaryProtocol implements binary protocol
@@ -183,39 +223,48 @@ type BinaryProtocol struct {
 }
 
 func (protocol BinaryProtocol) fetch(keys []string, withCAS bool) ([]*Item, error) {
-	if protocol.poolSize == 1 {
-		return protocol.fetchFromServer(0, keys, withCAS)
-	}
-	array := make([][]string, protocol.poolSize)
-	for _, key := range keys {
-		index := protocol.getPoolIndex(key)
-		array[index] = append(array[index], key)
-	}
-	var wg sync.WaitGroup
-	var err error
+	var mu sync.Mutex
 	results := make([]*Item, 0, len(keys))
-	for index, ks := range array {
-		if ks == nil {
-			continue
+	err := protocol.fanOut(keys, func(index int, ks []string) error {
+		result, err := protocol.fetchFromServer(index, ks, withCAS, nil)
+		if len(result) != 0 {
+			mu.Lock()
+			results = append(results, result...)
+			mu.Unlock()
 		}
-		wg.Add(1)
-		go func(idx int, iks []string, cas bool) {
-			result, e := protocol.fetchFromServer(idx, iks, cas)
-			if e != nil {
-				err = e
-			}
-			if len(result) != 0 {
-				results = append(results, result...)
-			}
-			wg.Done()
-		}(index, ks, withCAS)
-	}
-	wg.Wait()
+		return err
+	})
 	return results, err
 }
 
-func (protocol BinaryProtocol) fetchFromServer(index int, keys []string, withCAS bool) ([]*Item, error) {
+func (protocol BinaryProtocol) fetchFromServer(index int, keys []string, withCAS bool, cancel <-chan struct{}) ([]*Item, error) {
+	results := make([]*Item, 0, len(keys))
+	err := protocol.scanFromServer(index, keys, withCAS, nil, cancel, func(item *Item) {
+		results = append(results, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (protocol BinaryProtocol) scan(keys []string, withCAS bool, buf []byte, fn func(item *Item)) error {
+	var mu sync.Mutex
+	return protocol.fanOut(keys, func(index int, ks []string) error {
+		return protocol.scanFromServer(index, ks, withCAS, protocol.scanBuffer(keys, buf), nil, func(item *Item) {
+			mu.Lock()
+			fn(item)
+			mu.Unlock()
+		})
+	})
+}
+
+// scanFromServer call fn for every item found. When buf is nil every item
+// is newly allocated, otherwise the item and its value stored in buf are
+// reused and only valid during fn. The read fails once cancel is closed.
+func (protocol BinaryProtocol) scanFromServer(index int, keys []string, withCAS bool, buf []byte, cancel <-chan struct{}, fn func(item *Item)) error {
 	count := len(keys)
+	opaque := nextOpaque()
 	buffer := new(bytes.Buffer)
 	for index, key := range keys {
 		op := operations["getkq"]
@@ -230,57 +279,82 @@ func (protocol BinaryProtocol) fetchFromServer(index int, keys []string, withCAS
 				opcode:     op.opcode,
 				keyLength:  uint16(keyLength),
 				bodyLength: uint32(keyLength),
+				opaque:     opaque,
 			}, key: key}
 		if err := pkt.write(buffer); err != nil {
-			return nil, err
+			return err
 		}
 	}
 	pool := protocol.pools[index]
 	conn, err := pool.Get()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	conn.watch(cancel)
 	if _, err = buffer.WriteTo(conn); err != nil {
 		conn.SetError(err)
 		pool.Put(conn)
-		return nil, err
+		return err
+	}
+	var reused *Item
+	if buf != nil {
+		reused = new(Item)
 	}
 	lastKey := keys[count-1]
-	results := make([]*Item, 0, count)
+	pkt := new(packet)
 	for {
-		pkt := new(packet)
-		err = pkt.read(conn)
+		body, err := pkt.readReply(conn, buf, opaque)
 		if err != nil && err != ErrItemNotFound {
-			if pkt.status != 0 {
-				conn.SetError(err)
-			}
+			// replies of the following keys are left unread
+			conn.SetError(err)
 			pool.Put(conn)
-			return nil, err
+			return err
+		}
+		if buf != nil {
+			buf = body
 		}
 		// skip if the key doesn't exist
 		if err == ErrItemNotFound && pkt.key != lastKey {
 			continue
 		}
-		if pkt.value != nil {
+		if err == nil {
 			var flags uint32
 			if pkt.extras != nil {
 				flags = binary.BigEndian.Uint32(pkt.extras)
 			}
-			item := &Item{Key: pkt.key, Value: pkt.value, Flags: flags, CAS: pkt.cas}
-			results = append(results, item)
+			item := reused
+			if item == nil {
+				item = new(Item)
+			}
+			*item = Item{Key: pkt.key, Value: pkt.value, Flags: flags, CAS: pkt.cas}
+			fn(item)
 		}
 		if pkt.key == lastKey {
 			break
 		}
 	}
-	if err = pool.Put(conn); err != nil {
-		return nil, err
-	}
-	return results, nil
+	return pool.Put(conn)
 }
 
 // Store for store items to the server
 func (protocol BinaryProtocol) store(cmd string, item *Item) error {
+	return protocol.storeFrom(cmd, item, int64(len(item.Value)), nil)
+}
+
+// storeFrom store the item with size bytes value read from r,
+// item.Value is used when r is nil.
+func (protocol BinaryProtocol) storeFrom(cmd string, item *Item, size int64, r io.Reader) error {
+	return protocol.storeFromServer(protocol.serverIndex(item.Key), cmd, item, size, r)
+}
+
+// storeToServer store the item to the server of index
+func (protocol BinaryProtocol) storeToServer(index int, cmd string, item *Item) error {
+	return protocol.storeFromServer(index, cmd, item, int64(len(item.Value)), nil)
+}
+
+// storeFromServer store the item with size bytes value read from r to the
+// server of index, item.Value is used when r is nil.
+func (protocol BinaryProtocol) storeFromServer(index int, cmd string, item *Item, size int64, r io.Reader) error {
 	if cmd == "cas" {
 		cmd = "set"
 	}
@@ -296,15 +370,23 @@ func (protocol BinaryProtocol) store(cmd string, item *Item) error {
 			keyLength:  uint16(keyLength),
 			cas:        item.CAS,
 			bodyLength: uint32(keyLength),
+			opaque:     nextOpaque(),
 		}, key: item.Key}
-	if isStoreOperation(op) {
-		pkt.value = item.Value
+	isStored := isStoreOperation(op)
+	if isStored {
+		if r == nil {
+			pkt.value = item.Value
+		}
 		extrasLength := 8
+		// the body length of packets is 32 bits
+		if size < 0 || size > math.MaxUint32-int64(keyLength+extrasLength) {
+			return ErrInvalidSize
+		}
 		pkt.extras = make([]byte, extrasLength)
 		binary.BigEndian.PutUint32(pkt.extras[:4], item.Flags)
 		binary.BigEndian.PutUint32(pkt.extras[4:], item.Expiration)
 		pkt.extrasLength = uint8(extrasLength)
-		pkt.bodyLength = uint32(pkt.keyLength) + uint32(len(pkt.value)) + uint32(extrasLength)
+		pkt.bodyLength = uint32(pkt.keyLength) + uint32(size) + uint32(extrasLength)
 	}
 	if op.command == "incr" || op.command == "decr" {
 		delta, err := strconv.ParseUint(string(item.Value), 10, 64)
@@ -315,14 +397,11 @@ func (protocol BinaryProtocol) store(cmd string, item *Item) error {
 		pkt.extras = make([]byte, extrasLength)
 		binary.BigEndian.PutUint64(pkt.extras[:8], delta)
 		binary.BigEndian.PutUint64(pkt.extras[8:16], 0)
-		binary.BigEndian.PutUint32(pkt.extras[16:], item.Expiration)
+		// fail on missing keys as text protocol does
+		binary.BigEndian.PutUint32(pkt.extras[16:], 0xffffffff)
 		pkt.extrasLength = uint8(extrasLength)
 		pkt.bodyLength = uint32(pkt.keyLength) + uint32(extrasLength)
 	}
-	var index uint32
-	if protocol.poolSize != 1 {
-		index = protocol.getPoolIndex(item.Key)
-	}
 	pool := protocol.pools[index]
 	conn, err := pool.Get()
 	if err != nil {
@@ -333,19 +412,233 @@ func (protocol BinaryProtocol) store(cmd string, item *Item) error {
 		pool.Put(conn)
 		return err
 	}
+	if isStored && r != nil {
+		// the value is partially sent when copy fails, so drop the connection
+		if _, err = io.CopyN(conn, r, size); err != nil {
+			conn.SetError(err)
+			pool.Put(conn)
+			return err
+		}
+	}
 	if op.quiet {
 		pool.Put(conn)
 		return err
 	}
-	if err := pkt.read(conn); err != nil {
-		if pkt.status != 0 {
+	if _, err := pkt.readReply(conn, nil, pkt.opaque); err != nil {
+		if pkt.status == 0 {
 			conn.SetError(err)
 		}
 		pool.Put(conn)
 		return err
 	}
-	item.Value = pkt.value
+	if op.command == "incr" || op.command == "decr" {
+		if len(pkt.value) != 8 {
+			pool.Put(conn)
+			return ErrInvalidResponseFormat
+		}
+		item.Value = strconv.AppendUint(nil, binary.BigEndian.Uint64(pkt.value), 10)
+	}
 	item.CAS = pkt.cas
 	pool.Put(conn)
 	return nil
 }
+
+// fetchTo write the value of key to the writer chosen by the item flags,
+// it returns ErrItemNotFound on miss
+func (protocol BinaryProtocol) fetchTo(key string, writer func(flags uint32) io.Writer) (uint32, error) {
+	keyLength := len(key)
+	pkt := &packet{
+		header: header{
+			magic:      requestMagic,
+			opcode:     operations["get"].opcode,
+			keyLength:  uint16(keyLength),
+			bodyLength: uint32(keyLength),
+			opaque:     nextOpaque(),
+		}, key: key}
+	pool := protocol.pools[protocol.getPoolIndex(key)]
+	conn, err := pool.Get()
+	if err != nil {
+		return 0, err
+	}
+	if err = pkt.write(conn); err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return 0, err
+	}
+	hdr := new(header)
+	for {
+		if err = hdr.read(conn); err != nil {
+			conn.SetError(err)
+			pool.Put(conn)
+			return 0, err
+		}
+		if hdr.status == 0 && hdr.opaque == pkt.opaque {
+			break
+		}
+		// discard the error message or the reply of other requests
+		if _, err = io.CopyN(io.Discard, conn, int64(hdr.bodyLength)); err != nil {
+			conn.SetError(err)
+			pool.Put(conn)
+			return 0, err
+		}
+		// skip replies of quiet requests before
+		if hdr.opaque != pkt.opaque {
+			continue
+		}
+		pool.Put(conn)
+		if e, ok := errorMap[hdr.status]; ok {
+			return 0, e
+		}
+		return 0, fmt.Errorf("server response status code error: %d", hdr.status)
+	}
+	extras := make([]byte, int(hdr.extrasLength)+int(hdr.keyLength))
+	if _, err = io.ReadFull(conn, extras); err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return 0, err
+	}
+	var flags uint32
+	if hdr.extrasLength >= 4 {
+		flags = binary.BigEndian.Uint32(extras)
+	}
+	size := int64(hdr.bodyLength) - int64(len(extras))
+	if _, err = io.CopyN(writer(flags), conn, size); err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return 0, err
+	}
+	pool.Put(conn)
+	return flags, nil
+}
+
+// stats retrieve the statistics of group from the server of index,
+// an empty group is the general-purpose statistics
+func (protocol BinaryProtocol) stats(index int, group string) (map[string]string, error) {
+	pkt := &packet{
+		header: header{
+			magic:      requestMagic,
+			opcode:     operations["stat"].opcode,
+			keyLength:  uint16(len(group)),
+			bodyLength: uint32(len(group)),
+			opaque:     nextOpaque(),
+		}, key: group}
+	pool := protocol.pools[index]
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	if err = pkt.write(conn); err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return nil, err
+	}
+	stats := make(map[string]string)
+	for {
+		// the response of every statistic is terminated by an empty key
+		resp := &packet{}
+		if _, err = resp.readReply(conn, nil, pkt.opaque); err != nil {
+			if resp.status == 0 {
+				conn.SetError(err)
+			}
+			pool.Put(conn)
+			return nil, err
+		}
+		if resp.key == "" {
+			break
+		}
+		stats[resp.key] = string(resp.value)
+	}
+	pool.Put(conn)
+	return stats, nil
+}
+
+// request send the packet to the server of index and read the response
+func (protocol BinaryProtocol) request(index int, pkt *packet) (*packet, error) {
+	pkt.opaque = nextOpaque()
+	pool := protocol.pools[index]
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	if err = pkt.write(conn); err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return nil, err
+	}
+	resp := &packet{}
+	if _, err = resp.readReply(conn, nil, pkt.opaque); err != nil && resp.status == 0 {
+		conn.SetError(err)
+	}
+	pool.Put(conn)
+	return resp, err
+}
+
+// flushAll invalidate all items of the server of index after delay seconds
+func (protocol BinaryProtocol) flushAll(index int, delay uint32) error {
+	pkt := &packet{header: header{magic: requestMagic, opcode: operations["flush"].opcode}}
+	if delay != 0 {
+		pkt.extras = make([]byte, 4)
+		binary.BigEndian.PutUint32(pkt.extras, delay)
+		pkt.extrasLength = 4
+		pkt.bodyLength = 4
+	}
+	_, err := protocol.request(index, pkt)
+	return err
+}
+
+// version return the version of the server of index
+func (protocol BinaryProtocol) version(index int) (string, error) {
+	pkt := &packet{header: header{magic: requestMagic, opcode: operations["version"].opcode}}
+	resp, err := protocol.request(index, pkt)
+	if err != nil {
+		return "", err
+	}
+	return string(resp.value), nil
+}
+
+// noop check the server of index responds
+func (protocol BinaryProtocol) noop(index int) error {
+	pkt := &packet{header: header{magic: requestMagic, opcode: operations["noop"].opcode}}
+	_, err := protocol.request(index, pkt)
+	return err
+}
+
+// saslAuth authenticate conn by SASL PLAIN mechanism
+func saslAuth(conn net.Conn, username, password string) error {
+	resp, err := saslRequest(conn, operations["saslList"].opcode, "", nil)
+	if err != nil {
+		return err
+	}
+	supported := false
+	for _, mechanism := range bytes.Fields(resp.value) {
+		supported = supported || string(mechanism) == "PLAIN"
+	}
+	if !supported {
+		return fmt.Errorf("SASL mechanism PLAIN isn't supported by server, it supports: %q", resp.value)
+	}
+	payload := []byte("\x00" + username + "\x00" + password)
+	_, err = saslRequest(conn, operations["saslAuth"].opcode, "PLAIN", payload)
+	if err == errAuthContinue {
+		// PLAIN has no challenge, so the step sends nothing
+		_, err = saslRequest(conn, operations["saslStep"].opcode, "PLAIN", nil)
+	}
+	return err
+}
+
+// saslRequest send a SASL request of opcode on conn and read the response
+func saslRequest(conn net.Conn, opcode uint8, mechanism string, data []byte) (*packet, error) {
+	pkt := &packet{
+		header: header{
+			magic:      requestMagic,
+			opcode:     opcode,
+			keyLength:  uint16(len(mechanism)),
+			bodyLength: uint32(len(mechanism) + len(data)),
+			opaque:     nextOpaque(),
+		}, key: mechanism, value: data}
+	if err := pkt.write(conn); err != nil {
+		return nil, err
+	}
+	resp := &packet{}
+	_, err := resp.readReply(conn, nil, pkt.opaque)
+	return resp, err
+}
@@ -0,0 +1,487 @@
+package gomemcache
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Cacher operations on items implemented by Client and MemoryCache,
+// code depending on Cacher can be tested with MemoryCache. Both reply
+// nil to Delete of a missing key while noreply is enabled, which is the
+// default, and ErrItemNotFound after SetNoreply(false).
+type Cacher interface {
+	Get(key string) (*Item, error)
+	Gets(key string) (*Item, error)
+	MultiGet(keys []string) ([]*Item, error)
+	GetInto(key string, dst []byte) (value []byte, flags uint32, err error)
+	MultiGetFunc(keys []string, fn func(key string, value []byte, flags uint32)) error
+	GetToWriter(key string, w io.Writer) (flags uint32, err error)
+	GetObject(key string, v interface{}) error
+	GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader func(ctx context.Context) ([]byte, error)) ([]byte, error)
+	Set(item *Item) error
+	SetFromReader(key string, size int64, r io.Reader, flags, expiration uint32) error
+	SetObject(key string, v interface{}, expiration uint32) error
+	Add(item *Item) error
+	CAS(item *Item) error
+	Replace(item *Item) error
+	Delete(key string) error
+	Increment(key string, delta uint64) (uint64, error)
+	Decrement(key string, delta uint64) (uint64, error)
+	GetLease(key string) (*Lease, error)
+	SetWithLease(item *Item, lease *Lease) error
+	Invalidate(key string) error
+	FlushAll(delay time.Duration) error
+	Ping() error
+}
+
+var (
+	_ Cacher = (*Client)(nil)
+	_ Cacher = (*MemoryCache)(nil)
+)
+
+// errNonNumeric the error of incr and decr on values which aren't numbers
+var errNonNumeric = ServerError("CLIENT_ERROR cannot increment or decrement non-numeric value")
+
+// memoryItem item stored in MemoryCache
+type memoryItem struct {
+	item Item
+	// expiresAt unix time the item expires at, zero means never expire
+	expiresAt int64
+	// storedAt time the item is stored at, items stored before a delayed
+	// FlushAll expire when it happens
+	storedAt time.Time
+	// stale is set by Invalidate
+	stale bool
+	// vivified marks the empty item created by GetLease on miss
+	vivified bool
+	// won is set once a lease of the stale or vivified item is granted
+	won bool
+}
+
+// MemoryCache in-memory Cacher with the semantics of memcached, such as
+// cas, add, replace, expiration and leases of meta protocol, errors are the
+// ones returned by Client in text and meta protocol.
+type MemoryCache struct {
+	mu         sync.Mutex
+	items      map[string]*memoryItem
+	cas        uint64
+	clock      func() time.Time
+	flushAt    time.Time
+	noreply    bool
+	codecFlags uint32
+	loads      loadGroup
+}
+
+// NewMemoryCache create an empty MemoryCache, noreply is enabled and
+// objects are marshaled by FlagsJSON as Client by default.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{items: make(map[string]*memoryItem), noreply: true, codecFlags: FlagsJSON}
+}
+
+// SetNoreply set noreply option as Client, Delete of a missing key returns
+// ErrItemNotFound only when it's disabled.
+func (cache *MemoryCache) SetNoreply(noreply bool) {
+	cache.mu.Lock()
+	cache.noreply = noreply
+	cache.mu.Unlock()
+}
+
+// SetCodec set the codec used by SetObject for values other than
+// []byte, string and int64, default is FlagsJSON.
+func (cache *MemoryCache) SetCodec(flags uint32) error {
+	if _, err := lookupCodec(flags); err != nil {
+		return err
+	}
+	cache.mu.Lock()
+	cache.codecFlags = flags
+	cache.mu.Unlock()
+	return nil
+}
+
+// SetClock replace the clock used to expire items, such as a fake clock
+// to test expiration without sleeping, nil restores the wall clock.
+func (cache *MemoryCache) SetClock(clock func() time.Time) {
+	cache.mu.Lock()
+	cache.clock = clock
+	cache.mu.Unlock()
+}
+
+// now return the current time of clock, it must be called with lock held
+func (cache *MemoryCache) now() time.Time {
+	if cache.clock != nil {
+		return cache.clock()
+	}
+	return nowFunc()
+}
+
+// lookup return the live item of key, it must be called with lock held
+func (cache *MemoryCache) lookup(key string) *memoryItem {
+	it, ok := cache.items[key]
+	if !ok {
+		return nil
+	}
+	now := cache.now()
+	flushed := !cache.flushAt.IsZero() && !now.Before(cache.flushAt) && !it.storedAt.After(cache.flushAt)
+	if flushed || (it.expiresAt != 0 && now.Unix() >= it.expiresAt) {
+		delete(cache.items, key)
+		return nil
+	}
+	return it
+}
+
+func (cache *MemoryCache) get(key string, withCAS bool) (*Item, error) {
+	if !invalidKey(key) {
+		return nil, ErrInvalidKey
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	it := cache.lookup(key)
+	if it == nil {
+		return nil, nil
+	}
+	item := copyItem(&it.item)
+	if !withCAS {
+		item.CAS = 0
+	}
+	return item, nil
+}
+
+// Get retrieve an item with a key, it returns nil if the key doesn't exist
+func (cache *MemoryCache) Get(key string) (*Item, error) {
+	return cache.get(key, false)
+}
+
+// Gets retrieve an item with a key, Item responses with CAS
+func (cache *MemoryCache) Gets(key string) (*Item, error) {
+	return cache.get(key, true)
+}
+
+// MultiGet retrieve bulk items with some keys
+func (cache *MemoryCache) MultiGet(keys []string) ([]*Item, error) {
+	var items []*Item
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		item, err := cache.get(key, false)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// store save the item according to the semantics of cmd
+func (cache *MemoryCache) store(cmd string, item *Item) error {
+	if !invalidKey(item.Key) {
+		return ErrInvalidKey
+	}
+	expiration, err := itemExpiration(item)
+	if err != nil {
+		return err
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	it := cache.lookup(item.Key)
+	switch cmd {
+	case "add":
+		if it != nil {
+			return ErrItemNotStored
+		}
+	case "replace":
+		if it == nil {
+			return ErrItemNotStored
+		}
+	case "cas":
+		if it == nil {
+			return ErrItemNotFound
+		}
+		if it.item.CAS != item.CAS {
+			return ErrItemExists
+		}
+	}
+	var expiresAt int64
+	if expiration > maxRelativeExpiration {
+		expiresAt = int64(expiration)
+	} else if expiration != 0 {
+		expiresAt = cache.now().Unix() + int64(expiration)
+	}
+	cache.cas++
+	stored := copyItem(item)
+	stored.Expiration, stored.TTL, stored.ExpiresAt = 0, 0, time.Time{}
+	stored.CAS = cache.cas
+	cache.items[item.Key] = &memoryItem{item: *stored, expiresAt: expiresAt, storedAt: cache.now()}
+	item.CAS = cache.cas
+	return nil
+}
+
+// Set store this item
+func (cache *MemoryCache) Set(item *Item) error {
+	return cache.store("set", item)
+}
+
+// Add store this item only if the key doesn't exist
+func (cache *MemoryCache) Add(item *Item) error {
+	return cache.store("add", item)
+}
+
+// CAS store this item only if it isn't updated since it's fetched by Gets
+func (cache *MemoryCache) CAS(item *Item) error {
+	return cache.store("cas", item)
+}
+
+// Replace store this item only if the key exists
+func (cache *MemoryCache) Replace(item *Item) error {
+	return cache.store("replace", item)
+}
+
+// Delete delete the item of key, it returns ErrItemNotFound if the key
+// doesn't exist and noreply is disabled.
+func (cache *MemoryCache) Delete(key string) error {
+	if !invalidKey(key) {
+		return ErrInvalidKey
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.lookup(key) == nil {
+		if cache.noreply {
+			return nil
+		}
+		return ErrItemNotFound
+	}
+	delete(cache.items, key)
+	return nil
+}
+
+// Increment add delta to the decimal value of key, the value wraps around at 64 bits
+func (cache *MemoryCache) Increment(key string, delta uint64) (uint64, error) {
+	return cache.incr(key, delta, false)
+}
+
+// Decrement subtract delta from the decimal value of key, the value stops at 0
+func (cache *MemoryCache) Decrement(key string, delta uint64) (uint64, error) {
+	return cache.incr(key, delta, true)
+}
+
+func (cache *MemoryCache) incr(key string, delta uint64, decr bool) (uint64, error) {
+	if !invalidKey(key) {
+		return 0, ErrInvalidKey
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	it := cache.lookup(key)
+	if it == nil {
+		return 0, ErrItemNotFound
+	}
+	value, err := strconv.ParseUint(string(it.item.Value), 10, 64)
+	if err != nil {
+		return 0, errNonNumeric
+	}
+	if !decr {
+		value += delta
+	} else if delta > value {
+		value = 0
+	} else {
+		value -= delta
+	}
+	cache.cas++
+	it.item.Value = strconv.AppendUint(nil, value, 10)
+	it.item.CAS = cache.cas
+	return value, nil
+}
+
+// GetInto retrieve the value of key into dst, dst is reused when it has
+// enough capacity. It returns ErrItemNotFound if the key doesn't exist.
+func (cache *MemoryCache) GetInto(key string, dst []byte) (value []byte, flags uint32, err error) {
+	item, err := cache.get(key, false)
+	if err != nil {
+		return dst[:0], 0, err
+	}
+	if item == nil {
+		return dst[:0], 0, ErrItemNotFound
+	}
+	return append(dst[:0], item.Value...), item.Flags, nil
+}
+
+// MultiGetFunc retrieve bulk items with some keys and call fn for every item found
+func (cache *MemoryCache) MultiGetFunc(keys []string, fn func(key string, value []byte, flags uint32)) error {
+	items, err := cache.MultiGet(keys)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		fn(item.Key, item.Value, item.Flags)
+	}
+	return nil
+}
+
+// GetToWriter retrieve the value of key and write it to w.
+// It returns ErrItemNotFound if the key doesn't exist.
+func (cache *MemoryCache) GetToWriter(key string, w io.Writer) (flags uint32, err error) {
+	item, err := cache.get(key, false)
+	if err != nil {
+		return 0, err
+	}
+	if item == nil {
+		return 0, ErrItemNotFound
+	}
+	_, err = w.Write(item.Value)
+	return item.Flags, err
+}
+
+// GetObject retrieve the item of key and unmarshal it into v with the codec
+// recorded in the item flags. It returns ErrItemNotFound if the key doesn't exist.
+func (cache *MemoryCache) GetObject(key string, v interface{}) error {
+	item, err := cache.get(key, false)
+	if err != nil {
+		return err
+	}
+	return unmarshalObject(item, v)
+}
+
+// GetOrLoad retrieve the value of key, on a miss the value is loaded by
+// loader and stored with ttl. Concurrent callers of the same key share one
+// loader call and the returned value, which must not be modified.
+func (cache *MemoryCache) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	item, err := cache.get(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if item != nil {
+		return item.Value, nil
+	}
+	return cache.loads.do(ctx, key, func() ([]byte, error) {
+		value, err := loader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cache.Set(&Item{Key: key, Value: value, Expiration: expirationOf(ttl)})
+		return value, nil
+	})
+}
+
+// SetFromReader store size bytes read from r as the value of key
+func (cache *MemoryCache) SetFromReader(key string, size int64, r io.Reader, flags, expiration uint32) error {
+	if !invalidKey(key) {
+		return ErrInvalidKey
+	}
+	if size < 0 {
+		return ErrInvalidSize
+	}
+	value := make([]byte, size)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return err
+	}
+	return cache.Set(&Item{Key: key, Value: value, Flags: flags, Expiration: expiration})
+}
+
+// SetObject marshal v and store it, the codec is recorded in the item flags
+// so that GetObject unmarshals it automatically.
+func (cache *MemoryCache) SetObject(key string, v interface{}, expiration uint32) error {
+	cache.mu.Lock()
+	codecFlags := cache.codecFlags
+	cache.mu.Unlock()
+	value, flags, err := marshalObject(v, codecFlags)
+	if err != nil {
+		return err
+	}
+	return cache.Set(&Item{Key: key, Value: value, Flags: flags, Expiration: expiration})
+}
+
+// GetLease retrieve the item of key with a lease as Client in meta protocol.
+// On a miss or a stale item exactly one caller wins the lease and should fill
+// the key with SetWithLease, others get the stale item or wait for the value.
+func (cache *MemoryCache) GetLease(key string) (*Lease, error) {
+	if !invalidKey(key) {
+		return nil, ErrInvalidKey
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	lease := new(Lease)
+	it := cache.lookup(key)
+	if it == nil {
+		// the empty item created on miss holds the lease
+		cache.cas++
+		now := cache.now()
+		it = &memoryItem{
+			item:      Item{Key: key, CAS: cache.cas},
+			expiresAt: now.Add(defaultLeaseTTL).Unix(),
+			storedAt:  now,
+			vivified:  true,
+			won:       true,
+		}
+		cache.items[key] = it
+		lease.Won = true
+	} else if it.stale || it.vivified {
+		lease.Won = !it.won
+		lease.Pending = it.won
+		it.won = true
+	}
+	lease.Stale = it.stale
+	lease.token = it.item.CAS
+	if lease.Stale || !(lease.Won || lease.Pending) {
+		lease.Item = copyItem(&it.item)
+	}
+	return lease, nil
+}
+
+// SetWithLease store the item with the lease won by GetLease, it returns
+// ErrItemExists if the key has been changed since the lease was granted.
+func (cache *MemoryCache) SetWithLease(item *Item, lease *Lease) error {
+	if !lease.Won {
+		return ErrLeaseNotWon
+	}
+	it := *item
+	it.CAS = lease.token
+	return cache.store("cas", &it)
+}
+
+// Invalidate mark the item of key stale instead of deleting it. The next
+// GetLease wins the lease to refill the key and sets with leases granted
+// before are rejected.
+func (cache *MemoryCache) Invalidate(key string) error {
+	if !invalidKey(key) {
+		return ErrInvalidKey
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	it := cache.lookup(key)
+	if it == nil {
+		return ErrItemNotFound
+	}
+	cache.cas++
+	it.item.CAS = cache.cas
+	it.stale, it.won = true, false
+	it.expiresAt = cache.now().Add(defaultLeaseTTL).Unix()
+	return nil
+}
+
+// FlushAll invalidate all items after delay, zero delay invalidates them at
+// once and negative delay returns ErrInvalidExpiration.
+func (cache *MemoryCache) FlushAll(delay time.Duration) error {
+	if delay < 0 {
+		return ErrInvalidExpiration
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if delay == 0 {
+		cache.items = make(map[string]*memoryItem)
+		cache.flushAt = time.Time{}
+		return nil
+	}
+	cache.flushAt = cache.now().Add(delay)
+	return nil
+}
+
+// Ping always succeeds since there is no server
+func (cache *MemoryCache) Ping() error {
+	return nil
+}
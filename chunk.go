@@ -0,0 +1,178 @@
+package gomemcache
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strconv"
+)
+
+const (
+	// flagChunked marks the manifest item of a value split into chunks
+	flagChunked uint32 = 1 << 31
+	// maxChunks the limit of chunks of a value
+	maxChunks = 1 << 16
+	// maxChunkKeyLength the limit of keys of chunked values, chunk keys
+	// append at most 20 bytes of the version and the index
+	maxChunkKeyLength = 230
+)
+
+// manifest is stored in place of a chunked value, chunk keys are derived
+// from the item key and the version so that a value is never assembled
+// from chunks of different writes.
+type manifest struct {
+	version uint64
+	count   uint32
+	size    uint64
+}
+
+const manifestSize = 20
+
+func (m manifest) bytes() []byte {
+	buf := make([]byte, manifestSize)
+	binary.BigEndian.PutUint64(buf[:8], m.version)
+	binary.BigEndian.PutUint32(buf[8:12], m.count)
+	binary.BigEndian.PutUint64(buf[12:], m.size)
+	return buf
+}
+
+func parseManifest(buf []byte) (manifest, error) {
+	if len(buf) != manifestSize {
+		return manifest{}, ErrInvalidResponseFormat
+	}
+	m := manifest{
+		version: binary.BigEndian.Uint64(buf[:8]),
+		count:   binary.BigEndian.Uint32(buf[8:12]),
+		size:    binary.BigEndian.Uint64(buf[12:]),
+	}
+	// every chunk holds one byte at least
+	if m.count == 0 || m.count > maxChunks || uint64(m.count) > m.size {
+		return manifest{}, ErrInvalidResponseFormat
+	}
+	return m, nil
+}
+
+func (m manifest) chunkKey(key string, index int) string {
+	return key + ":" + strconv.FormatUint(m.version, 36) + ":" + strconv.Itoa(index)
+}
+
+func newVersion() uint64 {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return uint64(nowFunc().UnixNano())
+	}
+	return binary.BigEndian.Uint64(buf)
+}
+
+// SetChunkSize split values larger than size into chunks of size bytes,
+// it should be less than the item size limit of memcached (-I, 1MB by
+// default). Values are split into 65536 chunks at most, and keys of
+// chunked values must be less than 230 bytes. Chunks of overwritten or
+// deleted values are not deleted, they expire with the value or stay until
+// evicted when it never expires. Clients reading chunked values must enable
+// chunking too, the size of readers doesn't matter. Zero size disables chunking.
+func (client *Client) SetChunkSize(size int) {
+	client.chunkSize = size
+}
+
+// splitChunks store the value of item in chunks and return the manifest item
+func (client *Client) splitChunks(item *Item) (*Item, error) {
+	size := client.chunkSize
+	count := (len(item.Value) + size - 1) / size
+	if count > maxChunks {
+		return nil, ErrTooManyChunks
+	}
+	if len(item.Key) > maxChunkKeyLength {
+		return nil, ErrChunkKeyTooLong
+	}
+	m := manifest{version: newVersion(), count: uint32(count), size: uint64(len(item.Value))}
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(item.Value) {
+			end = len(item.Value)
+		}
+		chunk := &Item{Key: m.chunkKey(item.Key, i), Value: item.Value[i*size : end], Expiration: item.Expiration}
+		if !invalidKey(chunk.Key) {
+			return nil, ErrInvalidKey
+		}
+		// chunks must be stored before the manifest, so wait for the reply
+		if err := client.store("set", chunk); err != nil {
+			return nil, err
+		}
+	}
+	return &Item{
+		Key:        item.Key,
+		Value:      m.bytes(),
+		Expiration: item.Expiration,
+		Flags:      item.Flags | flagChunked,
+		CAS:        item.CAS,
+	}, nil
+}
+
+// joinChunks assemble chunked items from their chunks, an item is dropped
+// as a miss when its manifest is invalid or any chunk is missing.
+func (client *Client) joinChunks(items []*Item) ([]*Item, error) {
+	var keys []string
+	manifests := make(map[*Item]manifest)
+	invalid := make(map[*Item]struct{})
+	for _, item := range items {
+		if item.Flags&flagChunked == 0 {
+			continue
+		}
+		m, err := parseManifest(item.Value)
+		if err != nil {
+			invalid[item] = struct{}{}
+			continue
+		}
+		manifests[item] = m
+		for i := 0; i < int(m.count); i++ {
+			keys = append(keys, m.chunkKey(item.Key, i))
+		}
+	}
+	if len(manifests) == 0 && len(invalid) == 0 {
+		return items, nil
+	}
+	var chunks []*Item
+	if len(keys) != 0 {
+		var err error
+		if chunks, err = client.fetch(keys, false); err != nil {
+			return nil, err
+		}
+	}
+	values := make(map[string][]byte, len(chunks))
+	for _, chunk := range chunks {
+		values[chunk.Key] = chunk.Value
+	}
+	results := items[:0]
+	for _, item := range items {
+		if _, ok := invalid[item]; ok {
+			continue
+		}
+		m, ok := manifests[item]
+		if !ok {
+			results = append(results, item)
+			continue
+		}
+		// the value is allocated by the size of chunks read, not the manifest
+		var size uint64
+		parts := make([][]byte, 0, m.count)
+		for i := 0; i < int(m.count); i++ {
+			chunk, ok := values[m.chunkKey(item.Key, i)]
+			if !ok {
+				break
+			}
+			parts = append(parts, chunk)
+			size += uint64(len(chunk))
+		}
+		if len(parts) != int(m.count) || size != m.size {
+			continue
+		}
+		value := make([]byte, 0, size)
+		for _, part := range parts {
+			value = append(value, part...)
+		}
+		item.Value = value
+		item.Flags &^= flagChunked
+		results = append(results, item)
+	}
+	return results, nil
+}
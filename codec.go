@@ -0,0 +1,210 @@
+package gomemcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Flags recording the codec of values stored by SetObject,
+// the codec is kept in bits 16-23 of Item.Flags.
+const (
+	FlagsBytes uint32 = iota << 16
+	FlagsString
+	FlagsJSON
+	FlagsGob
+	FlagsInt64
+)
+
+// codecFlagsMask bits of Item.Flags recording the codec
+const codecFlagsMask uint32 = 0xff << 16
+
+var (
+	// ErrUnknownCodec indicates no codec is registered for the item flags
+	ErrUnknownCodec = errors.New("codec of the item flags is not registered")
+
+	codecMu sync.RWMutex
+	codecs  = map[uint32]Codec{
+		FlagsBytes:  bytesCodec{},
+		FlagsString: stringCodec{},
+		FlagsJSON:   jsonCodec{},
+		FlagsGob:    gobCodec{},
+		FlagsInt64:  int64Codec{},
+	}
+)
+
+// Codec marshal values stored by SetObject and read by GetObject
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// RegisterCodec register codec for flags, flags must only use the codec
+// bits (16-23) of Item.Flags, built-in codecs can be replaced.
+func RegisterCodec(flags uint32, codec Codec) error {
+	if flags&^codecFlagsMask != 0 {
+		return fmt.Errorf("codec flags %#x must only use bits 16-23", flags)
+	}
+	codecMu.Lock()
+	codecs[flags] = codec
+	codecMu.Unlock()
+	return nil
+}
+
+// lookupCodec return the codec recorded in flags
+func lookupCodec(flags uint32) (Codec, error) {
+	codecMu.RLock()
+	codec, ok := codecs[flags&codecFlagsMask]
+	codecMu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return codec, nil
+}
+
+type bytesCodec struct{}
+
+func (bytesCodec) Marshal(v interface{}) ([]byte, error) {
+	if b, ok := v.([]byte); ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("bytes codec can't marshal %T", v)
+}
+
+func (bytesCodec) Unmarshal(data []byte, v interface{}) error {
+	if b, ok := v.(*[]byte); ok {
+		*b = append((*b)[:0], data...)
+		return nil
+	}
+	return fmt.Errorf("bytes codec can't unmarshal into %T", v)
+}
+
+type stringCodec struct{}
+
+func (stringCodec) Marshal(v interface{}) ([]byte, error) {
+	if s, ok := v.(string); ok {
+		return []byte(s), nil
+	}
+	return nil, fmt.Errorf("string codec can't marshal %T", v)
+}
+
+func (stringCodec) Unmarshal(data []byte, v interface{}) error {
+	if s, ok := v.(*string); ok {
+		*s = string(data)
+		return nil
+	}
+	return fmt.Errorf("string codec can't unmarshal into %T", v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// int64Codec store the decimal text so that values work with incr and decr
+type int64Codec struct{}
+
+func (int64Codec) Marshal(v interface{}) ([]byte, error) {
+	if n, ok := v.(int64); ok {
+		return []byte(strconv.FormatInt(n, 10)), nil
+	}
+	return nil, fmt.Errorf("int64 codec can't marshal %T", v)
+}
+
+func (int64Codec) Unmarshal(data []byte, v interface{}) error {
+	n, ok := v.(*int64)
+	if !ok {
+		return fmt.Errorf("int64 codec can't unmarshal into %T", v)
+	}
+	i, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return err
+	}
+	*n = i
+	return nil
+}
+
+// SetCodec set the codec used by SetObject for values other than
+// []byte, string and int64, default is FlagsJSON.
+func (client *Client) SetCodec(flags uint32) error {
+	if _, err := lookupCodec(flags); err != nil {
+		return err
+	}
+	client.codecFlags = flags
+	return nil
+}
+
+// SetObject marshal v and store it, the codec is recorded in the item flags
+// so that GetObject unmarshals it automatically.
+func (client *Client) SetObject(key string, v interface{}, expiration uint32) error {
+	value, flags, err := marshalObject(v, client.codecFlags)
+	if err != nil {
+		return err
+	}
+	return client.Set(&Item{Key: key, Value: value, Flags: flags, Expiration: expiration})
+}
+
+// GetObject retrieve the item of key and unmarshal it into v with the codec
+// recorded in the item flags. It returns ErrItemNotFound if the key doesn't exist.
+func (client *Client) GetObject(key string, v interface{}) error {
+	item, err := client.Get(key)
+	if err != nil {
+		return err
+	}
+	return unmarshalObject(item, v)
+}
+
+// marshalObject marshal v by the codec of flags, []byte, string and int64
+// are marshaled by their own codecs. It returns the flags of the codec used.
+func marshalObject(v interface{}, flags uint32) ([]byte, uint32, error) {
+	switch v.(type) {
+	case []byte:
+		flags = FlagsBytes
+	case string:
+		flags = FlagsString
+	case int64:
+		flags = FlagsInt64
+	}
+	codec, err := lookupCodec(flags)
+	if err != nil {
+		return nil, 0, err
+	}
+	value, err := codec.Marshal(v)
+	return value, flags, err
+}
+
+// unmarshalObject unmarshal the value of item into v with the codec recorded
+// in the item flags, nil item is ErrItemNotFound.
+func unmarshalObject(item *Item, v interface{}) error {
+	if item == nil {
+		return ErrItemNotFound
+	}
+	codec, err := lookupCodec(item.Flags)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(item.Value, v)
+}
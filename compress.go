@@ -0,0 +1,66 @@
+package gomemcache
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+const (
+	// flagCompressed marks values compressed by client
+	flagCompressed uint32 = 1 << 30
+	// maxDecompressedSize the limit of decompressed values
+	maxDecompressedSize = 128 << 20
+)
+
+// SetCompression compress values larger than threshold bytes with zlib,
+// values which don't get smaller are stored as is. Compressed values are
+// decompressed by Get, Gets and MultiGet of clients enabling compression.
+// Zero threshold disables compression.
+func (client *Client) SetCompression(threshold int) {
+	client.compressThreshold = threshold
+}
+
+// compress return the compressed item, or item itself if it's not smaller
+func compress(item *Item) (*Item, error) {
+	buf := new(bytes.Buffer)
+	w := zlib.NewWriter(buf)
+	if _, err := w.Write(item.Value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(item.Value) {
+		return item, nil
+	}
+	it := *item
+	it.Value = buf.Bytes()
+	it.Flags |= flagCompressed
+	return &it, nil
+}
+
+// decompress restore values of compressed items in place, items which
+// can't be decompressed or are larger than maxDecompressedSize are dropped.
+func decompress(items []*Item) []*Item {
+	results := items[:0]
+	for _, item := range items {
+		if item.Flags&flagCompressed == 0 {
+			results = append(results, item)
+			continue
+		}
+		r, err := zlib.NewReader(bytes.NewReader(item.Value))
+		if err != nil {
+			continue
+		}
+		// the size of values is decided by the server, so it's bounded
+		value, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil || len(value) > maxDecompressedSize {
+			continue
+		}
+		item.Value = value
+		item.Flags &^= flagCompressed
+		results = append(results, item)
+	}
+	return results
+}
@@ -0,0 +1,78 @@
+package gomemcache
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// flagEnvelope marks values wrapped with the metadata of the read-through API
+const flagEnvelope uint32 = 1 << 29
+
+const envelopeSize = 16
+
+// envelope metadata stored in front of values by GetOrLoad
+type envelope struct {
+	// delta is the time spent by the loader
+	delta time.Duration
+	// expiresAt is the logical expiration
+	expiresAt time.Time
+}
+
+// wrapEnvelope return the item with its value wrapped by envelope
+func wrapEnvelope(item *Item) *Item {
+	value := make([]byte, envelopeSize, envelopeSize+len(item.Value))
+	binary.BigEndian.PutUint64(value[:8], uint64(item.envelope.delta))
+	binary.BigEndian.PutUint64(value[8:], uint64(item.envelope.expiresAt.UnixNano()))
+	it := *item
+	it.Value = append(value, item.Value...)
+	it.Flags |= flagEnvelope
+	return &it
+}
+
+// openEnvelopes unwrap values of items in place, metadata are kept in item,
+// items too short to hold an envelope are dropped.
+func openEnvelopes(items []*Item) []*Item {
+	results := items[:0]
+	for _, item := range items {
+		if item.Flags&flagEnvelope == 0 {
+			results = append(results, item)
+			continue
+		}
+		if len(item.Value) < envelopeSize {
+			continue
+		}
+		item.envelope = &envelope{
+			delta:     time.Duration(binary.BigEndian.Uint64(item.Value[:8])),
+			expiresAt: time.Unix(0, int64(binary.BigEndian.Uint64(item.Value[8:envelopeSize]))),
+		}
+		item.Value = item.Value[envelopeSize:]
+		item.Flags &^= flagEnvelope
+		results = append(results, item)
+	}
+	return results
+}
+
+// SetEarlyExpiration make GetOrLoad refresh values before they expire with
+// the probabilistic early expiration (XFetch) algorithm, a larger beta
+// favors earlier refreshes and 1.0 is a good default. Values are stored with
+// the loader time and the logical expiration in an envelope, Get of every
+// client unwraps it.
+// Zero beta disables early expiration.
+func (client *Client) SetEarlyExpiration(beta float64) {
+	client.earlyBeta = beta
+}
+
+// expiredEarly decide whether the item should be refreshed before it expires,
+// refresh when now - delta * beta * ln(rand) >= expiration.
+func (client *Client) expiredEarly(item *Item) bool {
+	if client.earlyBeta <= 0 || item.envelope == nil {
+		return false
+	}
+	gap := -float64(item.envelope.delta) * client.earlyBeta * math.Log(rand.Float64())
+	if gap >= math.MaxInt64 {
+		return true
+	}
+	return !nowFunc().Add(time.Duration(gap)).Before(item.envelope.expiresAt)
+}
@@ -1 +1,3 @@
 module github.com/zeayes/gomemcache
+
+go 1.18
@@ -0,0 +1,102 @@
+package gomemcache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// HealthStatus overall status of servers
+type HealthStatus string
+
+const (
+	// HealthOK all servers respond
+	HealthOK HealthStatus = "ok"
+	// HealthDegraded some servers don't respond
+	HealthDegraded HealthStatus = "degraded"
+	// HealthDown no server responds
+	HealthDown HealthStatus = "down"
+)
+
+// ServerHealth health of a server, Latency is in nanoseconds in JSON
+type ServerHealth struct {
+	Address string        `json:"address"`
+	Healthy bool          `json:"healthy"`
+	Latency time.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+	Pool    PoolStats     `json:"pool"`
+}
+
+// HealthReport result of HealthCheck
+type HealthReport struct {
+	Status  HealthStatus   `json:"status"`
+	Servers []ServerHealth `json:"servers"`
+}
+
+// HealthCheck ping every server concurrently and report the latency, the
+// pool statistics and the overall status. Servers which don't respond before
+// ctx is done are unhealthy.
+func (client *Client) HealthCheck(ctx context.Context) HealthReport {
+	type result struct {
+		index   int
+		latency time.Duration
+		err     error
+	}
+	results := make(chan result, len(client.servers))
+	for index := range client.servers {
+		go func(index int) {
+			start := time.Now()
+			err := client.protocol.noop(index)
+			results <- result{index: index, latency: time.Since(start), err: err}
+		}(index)
+	}
+	report := HealthReport{Servers: make([]ServerHealth, len(client.servers))}
+	responded := make([]bool, len(client.servers))
+	healthy := 0
+wait:
+	for pending := len(client.servers); pending > 0; pending-- {
+		select {
+		case res := <-results:
+			responded[res.index] = true
+			report.Servers[res.index].Latency = res.latency
+			if res.err != nil {
+				report.Servers[res.index].Error = res.err.Error()
+				continue
+			}
+			report.Servers[res.index].Healthy = true
+			healthy++
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	for index, server := range client.servers {
+		report.Servers[index].Address = server
+		if !responded[index] {
+			report.Servers[index].Error = ctx.Err().Error()
+		}
+		report.Servers[index].Pool = client.protocol.poolStats(index)
+	}
+	switch healthy {
+	case len(client.servers):
+		report.Status = HealthOK
+	case 0:
+		report.Status = HealthDown
+	default:
+		report.Status = HealthDegraded
+	}
+	return report
+}
+
+// HealthHandler return the http.Handler serving HealthCheck as JSON, it
+// responds 503 when no server responds and 200 otherwise.
+func (client *Client) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := client.HealthCheck(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status == HealthDown {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
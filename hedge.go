@@ -0,0 +1,139 @@
+package gomemcache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgeP95 delay of SetHedging, the hedged read is sent once the first one
+// takes longer than the 95th percentile of recent reads.
+const HedgeP95 time.Duration = -1
+
+const (
+	// latencyWindow number of recent reads the percentile is estimated from
+	latencyWindow = 1000
+	// latencyEstimateEvery number of reads between two estimates, it's also
+	// the number of reads observed before the first estimate.
+	latencyEstimateEvery = 100
+)
+
+// latencies window of recent read latencies
+type latencies struct {
+	mu       sync.Mutex
+	samples  []time.Duration
+	next     int
+	added    int
+	estimate time.Duration
+}
+
+func newLatencies() *latencies {
+	return &latencies{samples: make([]time.Duration, 0, latencyWindow)}
+}
+
+// add record a latency, the percentile is estimated again every latencyEstimateEvery reads
+func (l *latencies) add(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < cap(l.samples) {
+		l.samples = append(l.samples, latency)
+	} else {
+		l.samples[l.next] = latency
+	}
+	l.next = (l.next + 1) % cap(l.samples)
+	l.added++
+	if l.added < latencyEstimateEvery {
+		return
+	}
+	l.added = 0
+	sorted := append([]time.Duration(nil), l.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	l.estimate = sorted[len(sorted)*95/100]
+}
+
+// p95 return the 95th percentile of recent latencies, 0 before it's estimated
+func (l *latencies) p95() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.estimate
+}
+
+// SetHedging send a second read to the next copy of keys when the first
+// server doesn't respond in delay, the first response holding items wins
+// and the slower read is canceled, its connection is closed. A miss is
+// reported only after both reads respond. It applies to Get and MultiGet
+// of clients keeping copies by SetReplicas. HedgeP95 delays by the 95th
+// percentile of recent reads of the first server, canceled reads count
+// until they're canceled, no hedged read is sent until 100 reads are
+// observed. Zero delay disables hedging.
+func (client *Client) SetHedging(delay time.Duration) {
+	client.hedgeDelay = delay
+	client.latencies = nil
+	if delay < 0 {
+		client.latencies = newLatencies()
+	}
+}
+
+// hedgedFetch read keys from the server of index, and from the server of
+// next as well if the first read doesn't respond in the hedge delay.
+func (client *Client) hedgedFetch(index, next int, keys []string) ([]*Item, error) {
+	// the canceled read may complete after SetHedging is called again
+	delay, latencies := client.hedgeDelay, client.latencies
+	if latencies != nil {
+		if delay = latencies.p95(); delay == 0 {
+			return client.timedFetch(latencies, index, keys, nil)
+		}
+	}
+	type result struct {
+		items []*Item
+		err   error
+	}
+	// buffered so that the canceled read doesn't block
+	results := make(chan result, 2)
+	cancel := make(chan struct{})
+	defer close(cancel)
+	go func() {
+		items, err := client.timedFetch(latencies, index, keys, cancel)
+		results <- result{items, err}
+	}()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.items, r.err
+	case <-timer.C:
+	}
+	go func() {
+		items, err := client.protocol.fetchFromServer(next, keys, false, cancel)
+		results <- result{items, err}
+	}()
+	first := <-results
+	if first.err == nil && len(first.items) != 0 {
+		return first.items, nil
+	}
+	second := <-results
+	if second.err == nil && (len(second.items) != 0 || first.err != nil) {
+		return second.items, nil
+	}
+	return first.items, first.err
+}
+
+// timedFetch read keys from the server of index, the latency of successful
+// or canceled reads is recorded to latencies if it isn't nil.
+func (client *Client) timedFetch(latencies *latencies, index int, keys []string, cancel <-chan struct{}) ([]*Item, error) {
+	start := time.Now()
+	items, err := client.protocol.fetchFromServer(index, keys, false, cancel)
+	if latencies == nil {
+		return items, err
+	}
+	if err != nil {
+		select {
+		case <-cancel:
+			// the read took this long at least
+		default:
+			return items, err
+		}
+	}
+	latencies.add(time.Since(start))
+	return items, err
+}
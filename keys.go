@@ -0,0 +1,142 @@
+package gomemcache
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+const maxKeyLength = 250
+
+// KeyTransformer transform keys of client before they're sent to server,
+// items are returned with the original keys.
+type KeyTransformer interface {
+	TransformKey(key string) string
+}
+
+// KeyTransformerFunc adapter to use functions as KeyTransformer
+type KeyTransformerFunc func(key string) string
+
+// TransformKey call fn(key)
+func (fn KeyTransformerFunc) TransformKey(key string) string {
+	return fn(key)
+}
+
+// PrefixKeys add prefix to every key, such as the name of service
+func PrefixKeys(prefix string) KeyTransformer {
+	return KeyTransformerFunc(func(key string) string {
+		return prefix + key
+	})
+}
+
+// HashLongKeys replace keys longer than maxLength bytes or containing blank
+// and control characters with "<readable prefix>:<sha1 hex>", the readable
+// prefix is the leading safe characters of the key. maxLength out of range
+// (0, 250] is 250.
+func HashLongKeys(maxLength int) KeyTransformer {
+	return hashLongKeys(maxLength, func(key string) string {
+		sum := sha1.Sum([]byte(key))
+		return hex.EncodeToString(sum[:])
+	})
+}
+
+// HashLongKeysXXHash is HashLongKeys with the 16 hex digits of xxhash (XXH64),
+// it's faster and leaves a longer readable prefix, but it isn't
+// cryptographic, so keys chosen by users can collide on purpose.
+func HashLongKeysXXHash(maxLength int) KeyTransformer {
+	return hashLongKeys(maxLength, func(key string) string {
+		return fmt.Sprintf("%016x", xxhash64([]byte(key)))
+	})
+}
+
+func hashLongKeys(maxLength int, digestOf func(key string) string) KeyTransformer {
+	if maxLength <= 0 || maxLength > maxKeyLength {
+		maxLength = maxKeyLength
+	}
+	return KeyTransformerFunc(func(key string) string {
+		if len(key) <= maxLength && invalidKey(key) {
+			return key
+		}
+		digest := digestOf(key)
+		size := 0
+		for size < len(key) && size < maxLength-len(digest)-1 && key[size] > ' ' && key[size] <= 0x7f {
+			size++
+		}
+		return key[:size] + ":" + digest
+	})
+}
+
+// Base64Keys encode keys with URL safe base64 so that binary keys can be
+// stored, keys longer than 187 bytes still exceed the limit after encoding.
+func Base64Keys() KeyTransformer {
+	return KeyTransformerFunc(func(key string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(key))
+	})
+}
+
+// ChainKeys apply transformers in order, such as
+// ChainKeys(PrefixKeys("service:"), HashLongKeys(0)).
+func ChainKeys(transformers ...KeyTransformer) KeyTransformer {
+	return KeyTransformerFunc(func(key string) string {
+		for _, transformer := range transformers {
+			key = transformer.TransformKey(key)
+		}
+		return key
+	})
+}
+
+// SetKeyTransformer transform keys of all operations with transformer,
+// keys are validated after they're transformed. Nil disables it.
+func (client *Client) SetKeyTransformer(transformer KeyTransformer) {
+	client.transformer = transformer
+}
+
+// key transform and validate the key
+func (client *Client) key(key string) (string, error) {
+	if client.transformer != nil {
+		key = client.transformer.TransformKey(key)
+	}
+	if !invalidKey(key) {
+		return "", ErrInvalidKey
+	}
+	return key, nil
+}
+
+// uniqueKeys transform and validate keys and remove the repeated ones,
+// origin maps transformed keys to original keys if keys are transformed.
+func (client *Client) uniqueKeys(keys []string) (ks []string, origin map[string]string, err error) {
+	ks = make([]string, 0, len(keys))
+	if client.transformer != nil {
+		origin = make(map[string]string, len(keys))
+	}
+	for _, key := range keys {
+		k, err := client.key(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		exists := false
+		for _, uk := range ks {
+			if uk == k {
+				exists = true
+			}
+		}
+		if !exists {
+			ks = append(ks, k)
+			if origin != nil {
+				origin[k] = key
+			}
+		}
+	}
+	return ks, origin, nil
+}
+
+// restoreKeys set the original keys of items
+func restoreKeys(items []*Item, origin map[string]string) {
+	if origin == nil {
+		return
+	}
+	for _, item := range items {
+		item.Key = origin[item.Key]
+	}
+}
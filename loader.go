@@ -0,0 +1,171 @@
+package gomemcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const loadLockPollInterval = 50 * time.Millisecond
+
+// call an in-flight load of a key
+type call struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+// loadGroup collapse concurrent loads of the same key into one
+type loadGroup struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// do run fn once for concurrent callers of key, callers stop waiting
+// when their ctx is done. Waiters whose ctx is still live load again when
+// fn fails by the ctx of the caller running it.
+func (group *loadGroup) do(ctx context.Context, key string, fn func() ([]byte, error)) ([]byte, error) {
+	for {
+		group.mu.Lock()
+		if group.calls == nil {
+			group.calls = make(map[string]*call)
+		}
+		c, ok := group.calls[key]
+		if !ok {
+			c = &call{done: make(chan struct{})}
+			group.calls[key] = c
+			group.mu.Unlock()
+			group.run(key, c, fn)
+			return c.value, c.err
+		}
+		group.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if ctx.Err() == nil && (errors.Is(c.err, context.Canceled) || errors.Is(c.err, context.DeadlineExceeded)) {
+			continue
+		}
+		return c.value, c.err
+	}
+}
+
+// run call fn for c and release waiters even if fn panics, the panic is
+// returned to waiters as an error and raised again in the caller.
+func (group *loadGroup) run(key string, c *call, fn func() ([]byte, error)) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			c.value, c.err = nil, fmt.Errorf("loader of key %s panics: %v", key, r)
+		}
+		group.mu.Lock()
+		delete(group.calls, key)
+		group.mu.Unlock()
+		close(c.done)
+		if r != nil {
+			panic(r)
+		}
+	}()
+	c.value, c.err = fn()
+}
+
+// SetLoadLock make GetOrLoad take a lock key with Add before calling the
+// loader, so that only one process regenerates a missing value while others
+// wait for it up to timeout. Zero timeout disables the lock.
+func (client *Client) SetLoadLock(timeout time.Duration) {
+	client.loadLock = timeout
+}
+
+// SetStaleWhileRevalidate make GetOrLoad keep values for window after ttl,
+// a value logically expired is returned at once and refreshed in background
+// with at most one refresh per key in this process. onError is called with
+// the error of a failed refresh, it can be nil. Zero window disables it.
+func (client *Client) SetStaleWhileRevalidate(window time.Duration, onError func(key string, err error)) {
+	client.staleWindow = window
+	client.onRefreshError = onError
+}
+
+// GetOrLoad retrieve the value of key, on a miss or an early expiration
+// the value is loaded by loader and stored with ttl. Concurrent callers of
+// the same key share one loader call and the returned value, which must not
+// be modified. Errors of the cache are ignored so that values are still loaded.
+func (client *Client) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if _, err := client.key(key); err != nil {
+		return nil, err
+	}
+	if item, err := client.Get(key); err == nil && item != nil {
+		if client.staleWindow > 0 && item.envelope != nil && !nowFunc().Before(item.envelope.expiresAt) {
+			client.revalidate(key, ttl, loader)
+			return item.Value, nil
+		}
+		if !client.expiredEarly(item) {
+			return item.Value, nil
+		}
+	}
+	return client.loads.do(ctx, key, func() ([]byte, error) {
+		return client.load(ctx, key, ttl, loader)
+	})
+}
+
+// revalidate refresh the value of key in background unless it's refreshing
+func (client *Client) revalidate(key string, ttl time.Duration, loader func(ctx context.Context) ([]byte, error)) {
+	client.refreshMu.Lock()
+	if client.refreshing == nil {
+		client.refreshing = make(map[string]struct{})
+	}
+	if _, ok := client.refreshing[key]; ok {
+		client.refreshMu.Unlock()
+		return
+	}
+	client.refreshing[key] = struct{}{}
+	client.refreshMu.Unlock()
+	go func() {
+		_, err := client.load(context.Background(), key, ttl, loader)
+		if err != nil && client.onRefreshError != nil {
+			client.onRefreshError(key, err)
+		}
+		client.refreshMu.Lock()
+		delete(client.refreshing, key)
+		client.refreshMu.Unlock()
+	}()
+}
+
+func (client *Client) load(ctx context.Context, key string, ttl time.Duration, loader func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if client.loadLock > 0 {
+		lock := &Item{Key: key + ":lock", Value: []byte("1"), Expiration: expirationOf(client.loadLock)}
+		err := client.Add(lock)
+		if err == nil {
+			defer client.Delete(lock.Key)
+		} else if err == ErrItemNotStored || err == ErrItemExists {
+			// another process is loading, wait for its value until the lock expires
+			deadline := nowFunc().Add(client.loadLock)
+			for nowFunc().Before(deadline) {
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(loadLockPollInterval):
+				}
+				if item, err := client.Get(key); err == nil && item != nil {
+					return item.Value, nil
+				}
+			}
+		}
+	}
+	start := nowFunc()
+	value, err := loader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	item := &Item{Key: key, Value: value, Expiration: expirationOf(ttl)}
+	if (client.earlyBeta > 0 || client.staleWindow > 0) && ttl > 0 {
+		now := nowFunc()
+		item.envelope = &envelope{delta: now.Sub(start), expiresAt: now.Add(ttl)}
+		// stale values are kept by memcached until the window passes
+		item.Expiration = expirationOf(ttl + client.staleWindow)
+	}
+	client.Set(item)
+	return value, nil
+}
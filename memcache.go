@@ -1,10 +1,14 @@
 package gomemcache
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -13,10 +17,13 @@ const (
 	defaultMaxActiveConns = 20
 	defaultIdleTimeout    = 600 * time.Second
 	defaultSocketTimeout  = 2 * time.Second
+
+	// memcached treats expiration longer than 30 days as unix time
+	maxRelativeExpiration = 60 * 60 * 24 * 30
 )
 
 var (
-	// ErrItemNotFound indicates the item was not found when command is cas/delete/incr/decr
+	// ErrItemNotFound indicates the item was not found when command is cas/delete/incr/decr/GetInto/GetToWriter/GetObject
 	ErrItemNotFound = errors.New("item is not found")
 	// ErrItemExists indicates the item has stored where command is cas
 	ErrItemExists = errors.New("item exists")
@@ -28,15 +35,43 @@ var (
 	ErrInvalidResponseFormat = errors.New("The server repsonse error value format")
 	// ErrInvalidKey indicates the key is invalid.
 	ErrInvalidKey = errors.New("invalid key, key must be less than 250 and can't contain black or control character")
+	// ErrReservedFlags indicates the item flags use the bits reserved by the envelope or enabled client features.
+	ErrReservedFlags = errors.New("the flag bits of envelopes or enabled chunking and compression are reserved")
+	// ErrTooManyChunks indicates the value needs more chunks than the limit, the chunk size should be larger.
+	ErrTooManyChunks = errors.New("value is split into more than 65536 chunks")
+	// ErrChunkKeyTooLong indicates the key of a chunked value is too long to derive chunk keys from.
+	ErrChunkKeyTooLong = errors.New("key of chunked value must be less than 230")
+	// ErrInvalidSize indicates the size of a streamed value is negative or too large.
+	ErrInvalidSize = errors.New("invalid size of value")
+	// ErrInvalidExpiration indicates the expiration of item is ambiguous or in the past.
+	ErrInvalidExpiration = errors.New("invalid expiration, set one of Expiration, TTL and ExpiresAt, and Expiration longer than 30 days must be unix time")
 )
 
+// ServerError error replied by server, such as SERVER_ERROR of text protocol
+type ServerError string
+
+func (err ServerError) Error() string {
+	return string(err)
+}
+
 // Item item stored in memcache server
 type Item struct {
-	Key        string
-	Value      []byte
+	Key   string
+	Value []byte
+	// Expiration raw expiration of memcached, it's seconds up to 30 days or
+	// unix time, only one of Expiration, TTL and ExpiresAt can be set
 	Expiration uint32
-	Flags      uint32
-	CAS        uint64
+	// TTL duration the item expires after, it's rounded up to seconds
+	TTL time.Duration
+	// ExpiresAt time the item expires at
+	ExpiresAt time.Time
+	// Flags opaque to the server, bit 29 is reserved by the envelope of
+	// GetOrLoad, bits 30-31 by chunking and compression when they're enabled
+	Flags uint32
+	CAS   uint64
+
+	// envelope metadata of values stored by GetOrLoad
+	envelope *envelope
 }
 
 // Protocol (binary or text) supported by memcached should implements interface
@@ -47,6 +82,17 @@ type Protocol interface {
 	setSocketTimeout(timeout time.Duration)
 	store(command string, item *Item) error
 	fetch(keys []string, withCAS bool) ([]*Item, error)
+	scan(keys []string, withCAS bool, buf []byte, fn func(item *Item)) error
+	storeFrom(command string, item *Item, size int64, r io.Reader) error
+	fetchTo(key string, writer func(flags uint32) io.Writer) (uint32, error)
+	serverIndex(key string) int
+	storeToServer(index int, command string, item *Item) error
+	fetchFromServer(index int, keys []string, withCAS bool, cancel <-chan struct{}) ([]*Item, error)
+	stats(index int, group string) (map[string]string, error)
+	flushAll(index int, delay uint32) error
+	version(index int) (string, error)
+	noop(index int) error
+	poolStats(index int) PoolStats
 }
 
 type baseProtocol struct {
@@ -59,6 +105,61 @@ func (protocol baseProtocol) getPoolIndex(key string) uint32 {
 	return protocol.hashFunc([]byte(key)) % protocol.poolSize
 }
 
+// serverIndex return the index of the server holding key
+func (protocol baseProtocol) serverIndex(key string) int {
+	if protocol.poolSize == 1 {
+		return 0
+	}
+	return int(protocol.getPoolIndex(key))
+}
+
+// fanOut group keys by server and call fn for every server concurrently
+func (protocol baseProtocol) fanOut(keys []string, fn func(index int, keys []string) error) error {
+	if len(keys) == 1 {
+		return fn(int(protocol.getPoolIndex(keys[0])), keys)
+	}
+	if protocol.poolSize == 1 {
+		return fn(0, keys)
+	}
+	array := make([][]string, protocol.poolSize)
+	for _, key := range keys {
+		index := protocol.getPoolIndex(key)
+		array[index] = append(array[index], key)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var err error
+	for index, ks := range array {
+		if ks == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, iks []string) {
+			if e := fn(idx, iks); e != nil {
+				mu.Lock()
+				err = e
+				mu.Unlock()
+			}
+			wg.Done()
+		}(index, ks)
+	}
+	wg.Wait()
+	return err
+}
+
+// scanBuffer the buffer used by one server scan, buf is only reused when
+// all keys are in one request since servers are scanned concurrently.
+func (protocol baseProtocol) scanBuffer(keys []string, buf []byte) []byte {
+	if buf == nil || (len(keys) != 1 && protocol.poolSize != 1) {
+		return make([]byte, 0)
+	}
+	return buf
+}
+
+func (protocol baseProtocol) poolStats(index int) PoolStats {
+	return protocol.pools[index].Stats()
+}
+
 func (protocol baseProtocol) setMaxIdleConns(maxIdleConns int) {
 	for _, pool := range protocol.pools {
 		pool.MaxIdleConns = maxIdleConns
@@ -91,6 +192,76 @@ type Client struct {
 	servers  []string
 	protocol Protocol
 	noreply  bool
+	batcher  *batcher
+	near     *nearCache
+	auth     *credentials
+	replicas int
+
+	hedgeDelay time.Duration
+	latencies  *latencies
+
+	transformer KeyTransformer
+
+	chunkSize         int
+	compressThreshold int
+	codecFlags        uint32
+
+	loads     loadGroup
+	loadLock  time.Duration
+	earlyBeta float64
+
+	staleWindow    time.Duration
+	onRefreshError func(key string, err error)
+	refreshMu      sync.Mutex
+	refreshing     map[string]struct{}
+}
+
+// expirationOf convert ttl to the expiration of memcached, ttl longer
+// than 30 days is converted to unix time. Zero ttl means never expire.
+func expirationOf(ttl time.Duration) uint32 {
+	if ttl <= 0 {
+		return 0
+	}
+	seconds := (ttl + time.Second - 1) / time.Second
+	if seconds > maxRelativeExpiration {
+		return uint32(nowFunc().Add(ttl).Unix())
+	}
+	return uint32(seconds)
+}
+
+// itemExpiration convert TTL or ExpiresAt of item to the expiration of
+// memcached, it rejects ambiguous values.
+func itemExpiration(item *Item) (uint32, error) {
+	set := 0
+	if item.Expiration != 0 {
+		set++
+	}
+	if item.TTL != 0 {
+		set++
+	}
+	if !item.ExpiresAt.IsZero() {
+		set++
+	}
+	if set > 1 {
+		return 0, ErrInvalidExpiration
+	}
+	now := nowFunc()
+	switch {
+	case item.TTL != 0:
+		if item.TTL < 0 {
+			return 0, ErrInvalidExpiration
+		}
+		return expirationOf(item.TTL), nil
+	case !item.ExpiresAt.IsZero():
+		if !item.ExpiresAt.After(now) {
+			return 0, ErrInvalidExpiration
+		}
+		return expirationOf(item.ExpiresAt.Sub(now)), nil
+	case item.Expiration > maxRelativeExpiration && int64(item.Expiration) <= now.Unix():
+		// seconds longer than 30 days are taken as unix time in the past
+		return 0, ErrInvalidExpiration
+	}
+	return item.Expiration, nil
 }
 
 func invalidKey(key string) bool {
@@ -109,7 +280,7 @@ func invalidKey(key string) bool {
 
 // NewClient create memcache client
 func NewClient(servers []string) (*Client, error) {
-	client := &Client{servers: servers, noreply: true}
+	client := &Client{servers: servers, noreply: true, codecFlags: FlagsJSON}
 	err := client.SetProtocol("text")
 	return client, err
 }
@@ -135,26 +306,31 @@ func (client *Client) SetSocketTimeout(timeout time.Duration) {
 
 // SetProtocol set the default protocol, it's TextProtocol or BinaryProtocol.
 func (client *Client) SetProtocol(protocol string) error {
-	if protocol != "text" && protocol != "binary" {
-		return fmt.Errorf("only support 'text' and 'binary' protocol")
+	if protocol != "text" && protocol != "binary" && protocol != "meta" {
+		return fmt.Errorf("only support 'text', 'binary' and 'meta' protocol")
 	}
 	poolSize := len(client.servers)
 	pools := make([]*Pool, 0, poolSize)
 	for _, server := range client.servers {
-		pool := Pool{
-			DialFunc: func() (Conn, error) {
-				conn, err := net.Dial("tcp", server)
-				if err != nil {
-					return nil, err
-				}
-				return conn, err
-			},
+		server := server
+		pool := &Pool{
 			IdleTimeout:    defaultIdleTimeout,
 			SocketTimeout:  defaultSocketTimeout,
 			MaxIdleConns:   defaultMaxIdleConns,
 			MaxActiveConns: defaultMaxActiveConns,
 		}
-		pools = append(pools, &pool)
+		pool.DialFunc = func() (Conn, error) {
+			conn, err := net.Dial("tcp", server)
+			if err != nil {
+				return nil, err
+			}
+			if err = client.authenticate(protocol, conn, pool.SocketTimeout); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+		pools = append(pools, pool)
 	}
 	base := baseProtocol{
 		pools:    pools,
@@ -163,9 +339,12 @@ func (client *Client) SetProtocol(protocol string) error {
 			return (((crc32.ChecksumIEEE(buf) & 0xffffffff) >> 16) & 0x7fff) | 1
 		},
 	}
-	if protocol == "text" {
+	switch protocol {
+	case "text":
 		client.protocol = TextProtocol{base}
-	} else {
+	case "meta":
+		client.protocol = MetaProtocol{TextProtocol{base}}
+	default:
 		client.protocol = BinaryProtocol{base}
 	}
 	return nil
@@ -177,106 +356,432 @@ func (client *Client) SetNoreply(noreply bool) {
 	client.noreply = noreply
 }
 
+// SetBatching coalesce concurrent Get calls arriving within window into
+// one request per server, a batch is sent earlier once it holds maxKeys keys.
+// Zero window disables batching.
+func (client *Client) SetBatching(window time.Duration, maxKeys int) {
+	if window <= 0 {
+		client.batcher = nil
+		return
+	}
+	client.batcher = newBatcher(window, maxKeys, func(keys []string) ([]*Item, error) {
+		return client.fetch(keys, false)
+	})
+}
+
+// encode apply client features on the item before it's stored
+func (client *Client) encode(item *Item) (*Item, error) {
+	if item.Flags&client.featureFlags() != 0 {
+		return nil, ErrReservedFlags
+	}
+	expiration, err := itemExpiration(item)
+	if err != nil {
+		return nil, err
+	}
+	if expiration != item.Expiration || item.TTL != 0 || !item.ExpiresAt.IsZero() {
+		it := *item
+		it.Expiration, it.TTL, it.ExpiresAt = expiration, 0, time.Time{}
+		item = &it
+	}
+	if item.envelope != nil {
+		item = wrapEnvelope(item)
+	}
+	if client.compressThreshold > 0 && len(item.Value) > client.compressThreshold {
+		if item, err = compress(item); err != nil {
+			return nil, err
+		}
+	}
+	if client.chunkSize > 0 && len(item.Value) > client.chunkSize {
+		return client.splitChunks(item)
+	}
+	return item, nil
+}
+
+// featureFlags flag bits used by the features enabled on client, other
+// bits of Item.Flags are left to callers. The envelope bit is always used
+// so that plain readers unwrap values stored by GetOrLoad.
+func (client *Client) featureFlags() uint32 {
+	flags := flagEnvelope
+	if client.chunkSize > 0 {
+		flags |= flagChunked
+	}
+	if client.compressThreshold > 0 {
+		flags |= flagCompressed
+	}
+	return flags
+}
+
+// decode restore items encoded by enabled client features and unwrap
+// envelopes, items which can't be restored are dropped as misses.
+func (client *Client) decode(items []*Item) ([]*Item, error) {
+	features := client.featureFlags()
+	if features&flagChunked != 0 {
+		var err error
+		if items, err = client.joinChunks(items); err != nil {
+			return nil, err
+		}
+	}
+	if features&flagCompressed != 0 {
+		items = decompress(items)
+	}
+	return openEnvelopes(items), nil
+}
+
+// storeItem transform the key, encode and store the item
+func (client *Client) storeItem(cmd string, item *Item) error {
+	key, err := client.key(item.Key)
+	if err != nil {
+		return err
+	}
+	it := item
+	if key != item.Key {
+		copied := *item
+		copied.Key = key
+		it = &copied
+	}
+	if it, err = client.encode(it); err != nil {
+		return err
+	}
+	client.invalidateNear(key)
+	err = client.store(cmd, it)
+	if it != item {
+		item.CAS = it.CAS
+	}
+	return err
+}
+
 // Set store this item
 func (client *Client) Set(item *Item) error {
-	if !invalidKey(item.Key) {
-		return ErrInvalidKey
+	cmd := "setq"
+	if !client.noreply {
+		cmd = "set"
 	}
+	return client.storeItem(cmd, item)
+}
+
+// SetFromReader store size bytes read from r as the value of key,
+// the value is streamed to the server without being buffered, so it's
+// stored as is without chunking and compression. Size must be less than
+// the item size limit of memcached (-I, 1MB by default).
+func (client *Client) SetFromReader(key string, size int64, r io.Reader, flags, expiration uint32) error {
+	key, err := client.key(key)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return ErrInvalidSize
+	}
+	if flags&client.featureFlags() != 0 {
+		return ErrReservedFlags
+	}
+	if _, err = itemExpiration(&Item{Expiration: expiration}); err != nil {
+		return err
+	}
+	client.invalidateNear(key)
 	cmd := "setq"
 	if !client.noreply {
 		cmd = "set"
 	}
-	return client.protocol.store(cmd, item)
+	if err = client.protocol.storeFrom(cmd, &Item{Key: key, Flags: flags, Expiration: expiration}, size, r); err != nil {
+		return err
+	}
+	// the value is consumed, so copies are dropped instead of being rewritten
+	return client.dropReplicas(key)
 }
 
 // Add store this data, but only if the server
 // *doesn't* already hold data for this key
 func (client *Client) Add(item *Item) error {
-	if !invalidKey(item.Key) {
-		return ErrInvalidKey
-	}
-	return client.protocol.store("add", item)
+	return client.storeItem("add", item)
 }
 
 // CAS store this item but only if no one
 // else has updated since I last fetched it
 func (client *Client) CAS(item *Item) error {
-	if !invalidKey(item.Key) {
-		return ErrInvalidKey
-	}
-	return client.protocol.store("cas", item)
+	return client.storeItem("cas", item)
 }
 
 // Replace store this data, but only if the
 // server *does* already hold data for this key
 func (client *Client) Replace(item *Item) error {
-	if !invalidKey(item.Key) {
-		return ErrInvalidKey
-	}
-	return client.protocol.store("replace", item)
+	return client.storeItem("replace", item)
 }
 
-// Gets retrieve an item from the server with a key, Item responses with CAS
-func (client *Client) Gets(key string) (*Item, error) {
-	if !invalidKey(key) {
-		return nil, ErrInvalidKey
+// get retrieve and decode an item, Get calls are served by the near cache
+// and batched if enabled
+func (client *Client) get(origin string, withCAS bool) (*Item, error) {
+	key, err := client.key(origin)
+	if err != nil {
+		return nil, err
+	}
+	var generation nearGenerations
+	if client.near != nil && !withCAS {
+		if item := client.near.get(key); item != nil {
+			item.Key = origin
+			return item, nil
+		}
+		generation = client.near.begin()
+	}
+	var items []*Item
+	if client.batcher != nil && !withCAS {
+		var item *Item
+		if item, err = client.batcher.get(key); item != nil {
+			items = []*Item{item}
+		}
+	} else {
+		items, err = client.fetch([]string{key}, withCAS)
 	}
-	items, err := client.protocol.fetch([]string{key}, true)
 	if err != nil {
 		return nil, err
 	}
+	if items, err = client.decode(items); err != nil {
+		return nil, err
+	}
 	if len(items) == 0 {
 		return nil, nil
 	}
+	if client.near != nil && !withCAS {
+		client.near.add(generation, items)
+	}
+	items[0].Key = origin
 	return items[0], nil
 }
 
+// Gets retrieve an item from the server with a key, Item responses with CAS
+func (client *Client) Gets(key string) (*Item, error) {
+	return client.get(key, true)
+}
+
 // Get retrieve an item from the server with a key.
 func (client *Client) Get(key string) (*Item, error) {
-	if !invalidKey(key) {
-		return nil, ErrInvalidKey
-	}
-	items, err := client.protocol.fetch([]string{key}, false)
+	return client.get(key, false)
+}
+
+// MultiGet retrieve bulk items with some keys
+func (client *Client) MultiGet(keys []string) ([]*Item, error) {
+	ks, origin, err := client.uniqueKeys(keys)
 	if err != nil {
 		return nil, err
 	}
-	if len(items) == 0 {
+	if len(ks) == 0 {
 		return nil, nil
 	}
-	return items[0], nil
+	if client.near == nil {
+		items, err := client.fetch(ks, false)
+		if err != nil {
+			return nil, err
+		}
+		if items, err = client.decode(items); err != nil {
+			return nil, err
+		}
+		restoreKeys(items, origin)
+		return items, nil
+	}
+	var hits []*Item
+	misses := ks[:0]
+	for _, key := range ks {
+		if item := client.near.get(key); item != nil {
+			hits = append(hits, item)
+		} else {
+			misses = append(misses, key)
+		}
+	}
+	if len(misses) == 0 {
+		restoreKeys(hits, origin)
+		return hits, nil
+	}
+	generation := client.near.begin()
+	items, err := client.fetch(misses, false)
+	if err != nil {
+		return nil, err
+	}
+	if items, err = client.decode(items); err != nil {
+		return nil, err
+	}
+	client.near.add(generation, items)
+	items = append(hits, items...)
+	restoreKeys(items, origin)
+	return items, nil
 }
 
-// MultiGet retrieve bulk items with some keys
-func (client *Client) MultiGet(keys []string) ([]*Item, error) {
-	ks := keys[:0]
-	for _, key := range keys {
-		exists := false
-		for _, k := range ks {
-			if k == key {
-				exists = true
-			}
+// scansServer reports whether reads can scan the first server directly,
+// otherwise they go through Get and MultiGet for the near cache and copies.
+func (client *Client) scansServer() bool {
+	return client.near == nil && client.replicas <= 1
+}
+
+// GetInto retrieve the value of key into dst, dst is reused when it has
+// enough capacity. It returns ErrItemNotFound if the key doesn't exist.
+// With the near cache or SetReplicas it reads as Get does.
+func (client *Client) GetInto(key string, dst []byte) (value []byte, flags uint32, err error) {
+	if !client.scansServer() {
+		item, err := client.Get(key)
+		if err != nil {
+			return dst[:0], 0, err
 		}
-		if !exists {
-			if !invalidKey(key) {
-				return nil, ErrInvalidKey
-			}
-			ks = append(ks, key)
+		if item == nil {
+			return dst[:0], 0, ErrItemNotFound
+		}
+		return append(dst[:0], item.Value...), item.Flags, nil
+	}
+	if key, err = client.key(key); err != nil {
+		return nil, 0, err
+	}
+	var encoded *Item
+	found := false
+	features := client.featureFlags()
+	err = client.protocol.scan([]string{key}, false, dst[:0], func(item *Item) {
+		value, flags, found = item.Value, item.Flags, true
+		if flags&features != 0 {
+			encoded = &Item{Key: item.Key, Value: append([]byte(nil), value...), Flags: flags}
+		}
+	})
+	if err != nil {
+		return dst[:0], 0, err
+	}
+	if encoded != nil {
+		items, err := client.decode([]*Item{encoded})
+		if err != nil {
+			return dst[:0], 0, err
+		}
+		if len(items) == 0 {
+			return dst[:0], 0, ErrItemNotFound
 		}
+		return append(dst[:0], items[0].Value...), items[0].Flags, nil
+	}
+	if !found {
+		return dst[:0], 0, ErrItemNotFound
+	}
+	return value, flags, nil
+}
+
+// MultiGetFunc retrieve bulk items with some keys and call fn for every
+// item found. Calls of fn are serialized, value is only valid during fn
+// since the buffer is reused by the next item. With the near cache or
+// SetReplicas it reads as MultiGet does.
+func (client *Client) MultiGetFunc(keys []string, fn func(key string, value []byte, flags uint32)) error {
+	if !client.scansServer() {
+		items, err := client.MultiGet(keys)
+		for _, item := range items {
+			fn(item.Key, item.Value, item.Flags)
+		}
+		return err
+	}
+	ks, origin, err := client.uniqueKeys(keys)
+	if err != nil {
+		return err
 	}
 	if len(ks) == 0 {
-		return nil, nil
+		return nil
+	}
+	var encoded []*Item
+	features := client.featureFlags()
+	err = client.protocol.scan(ks, false, nil, func(item *Item) {
+		if item.Flags&features != 0 {
+			encoded = append(encoded, &Item{Key: item.Key, Value: append([]byte(nil), item.Value...), Flags: item.Flags})
+			return
+		}
+		if origin != nil {
+			item.Key = origin[item.Key]
+		}
+		fn(item.Key, item.Value, item.Flags)
+	})
+	if err != nil || len(encoded) == 0 {
+		return err
+	}
+	items, err := client.decode(encoded)
+	if err != nil {
+		return err
+	}
+	restoreKeys(items, origin)
+	for _, item := range items {
+		fn(item.Key, item.Value, item.Flags)
+	}
+	return nil
+}
+
+// GetToWriter retrieve the value of key and write it to w without buffering
+// the whole value. It returns ErrItemNotFound if the key doesn't exist.
+// With the near cache or SetReplicas it reads as Get does, so the value
+// is buffered.
+func (client *Client) GetToWriter(key string, w io.Writer) (flags uint32, err error) {
+	if !client.scansServer() {
+		item, err := client.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		if item == nil {
+			return 0, ErrItemNotFound
+		}
+		_, err = w.Write(item.Value)
+		return item.Flags, err
+	}
+	if key, err = client.key(key); err != nil {
+		return 0, err
+	}
+	// values encoded by client features are decoded in memory
+	encoded := new(bytes.Buffer)
+	features := client.featureFlags()
+	flags, err = client.protocol.fetchTo(key, func(flags uint32) io.Writer {
+		if flags&features != 0 {
+			return encoded
+		}
+		return w
+	})
+	if err != nil || flags&features == 0 {
+		return flags, err
 	}
-	return client.protocol.fetch(ks, false)
+	items, err := client.decode([]*Item{{Key: key, Value: encoded.Bytes(), Flags: flags}})
+	if err != nil {
+		return 0, err
+	}
+	if len(items) == 0 {
+		return 0, ErrItemNotFound
+	}
+	_, err = w.Write(items[0].Value)
+	return items[0].Flags, err
 }
 
 // Delete explicit deletion of items
 func (client *Client) Delete(key string) error {
-	if !invalidKey(key) {
-		return ErrInvalidKey
+	key, err := client.key(key)
+	if err != nil {
+		return err
 	}
 	cmd := "deleteq"
 	if !client.noreply {
 		cmd = "delete"
 	}
-	return client.protocol.store(cmd, &Item{Key: key})
+	client.invalidateNear(key)
+	return client.store(cmd, &Item{Key: key})
+}
+
+// Increment add delta to the decimal value of key and return the new value,
+// the value wraps around at 64 bits. It returns ErrItemNotFound if the key
+// doesn't exist.
+func (client *Client) Increment(key string, delta uint64) (uint64, error) {
+	return client.incr("increment", key, delta)
+}
+
+// Decrement subtract delta from the decimal value of key and return the new
+// value, the value stops at 0. It returns ErrItemNotFound if the key doesn't exist.
+func (client *Client) Decrement(key string, delta uint64) (uint64, error) {
+	return client.incr("decrement", key, delta)
+}
+
+func (client *Client) incr(cmd, key string, delta uint64) (uint64, error) {
+	key, err := client.key(key)
+	if err != nil {
+		return 0, err
+	}
+	client.invalidateNear(key)
+	item := &Item{Key: key, Value: []byte(strconv.FormatUint(delta, 10))}
+	if err = client.store(cmd, item); err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(string(item.Value), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidResponseFormat
+	}
+	return value, nil
 }
@@ -2,27 +2,89 @@ package gomemcache
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/zeayes/gomemcache/memcachetest"
+)
+
+var (
+	testServers        []string
+	client, textClient *Client
 )
 
-var client, textClient *Client
+// testProtocols protocols every client test runs in
+var testProtocols = []string{"binary", "text"}
 
+// init start memcachetest servers, or test against the comma separated
+// memcached servers of MEMCACHE_SERVERS if it's set.
 func init() {
+	if servers := os.Getenv("MEMCACHE_SERVERS"); servers != "" {
+		testServers = strings.Split(servers, ",")
+	}
+	for len(testServers) < 2 {
+		server, err := memcachetest.NewServer()
+		if err != nil {
+			os.Exit(1)
+		}
+		testServers = append(testServers, server.Addr())
+	}
 	var err error
-	client, err = NewClient([]string{"127.0.0.1:11211", "127.0.0.1:11213"})
+	client, err = NewClient(testServers)
 	if err != nil {
 		os.Exit(1)
 	}
 	client.SetProtocol("binary")
-	textClient, err = NewClient([]string{"127.0.0.1:11211", "127.0.0.1:11213"})
+	textClient, err = NewClient(testServers)
 	if err != nil {
 		os.Exit(1)
 	}
 }
 
+// newTestClient create a client of servers in protocol, writes wait for
+// replies so that they are seen by the reads of other connections.
+func newTestClient(t *testing.T, protocol string, servers ...string) *Client {
+	t.Helper()
+	c, err := NewClient(servers)
+	if err != nil {
+		t.Fatalf("init client error: %v", err)
+	}
+	if err = c.SetProtocol(protocol); err != nil {
+		t.Fatalf("client %s set protocol error: %v", protocol, err)
+	}
+	c.SetNoreply(false)
+	return c
+}
+
+// forEachProtocol run fn as a subtest of every protocol of testProtocols
+// with a new client of testServers.
+func forEachProtocol(t *testing.T, fn func(t *testing.T, protocol string, c *Client)) {
+	for _, protocol := range testProtocols {
+		protocol := protocol
+		t.Run(protocol, func(t *testing.T) {
+			fn(t, protocol, newTestClient(t, protocol, testServers...))
+		})
+	}
+}
+
+// setNow fake the clock of nowFunc until the test ends, tests faking the
+// clock can't run in parallel.
+func setNow(t *testing.T, now time.Time) {
+	nowFunc = func() time.Time { return now }
+	t.Cleanup(func() { nowFunc = time.Now })
+}
+
 type TestCase struct {
 	client   *Client
 	protocol string
@@ -341,6 +403,1745 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestGetInto(t *testing.T) {
+	testcases := []TestCase{
+		{client: client, protocol: "binary", command: "get_into"},
+		{client: textClient, protocol: "text", command: "get_into"},
+	}
+	for _, testcase := range testcases {
+		flags := uint32(1000)
+		key := fmt.Sprintf("test_%s_%s_key", testcase.protocol, testcase.command)
+		value := []byte(fmt.Sprintf("test_%s_%s_value", testcase.protocol, testcase.command))
+		if err := testcase.client.Set(&Item{Key: key, Value: value, Flags: flags}); err != nil {
+			t.Fatalf("client %s set error: %v", testcase.protocol, err)
+		}
+		dst := make([]byte, 0, 1024)
+		result, f, err := testcase.client.GetInto(key, dst)
+		if err != nil {
+			t.Fatalf("client %s GetInto error: %v", testcase.protocol, err)
+		}
+		if !bytes.Equal(value, result) {
+			t.Fatalf("client %s GetInto value expect: %v but got: %v", testcase.protocol, string(value), string(result))
+		}
+		if flags != f {
+			t.Fatalf("client %s GetInto flags expect: %v but got: %v", testcase.protocol, flags, f)
+		}
+		// the result must share the backing array of dst
+		if &dst[:cap(dst)][cap(dst)-1] != &result[:cap(result)][cap(result)-1] {
+			t.Fatalf("client %s GetInto should reuse the buffer", testcase.protocol)
+		}
+		if _, _, err = testcase.client.GetInto(key+"_missing", dst); err != ErrItemNotFound {
+			t.Fatalf("client %s GetInto missing key expect: %v but got: %v", testcase.protocol, ErrItemNotFound, err)
+		}
+	}
+}
+
+func TestMultiGetFunc(t *testing.T) {
+	testcases := []TestCase{
+		{client: client, protocol: "binary", command: "multiGetFunc"},
+		{client: textClient, protocol: "text", command: "multiGetFunc"},
+	}
+	for _, testcase := range testcases {
+		num := 10
+		keys := make([]string, 0, num)
+		expect := make(map[string][]byte, num)
+		for i := 0; i < num; i++ {
+			key := fmt.Sprintf("test_%s_%s_key_%d", testcase.protocol, testcase.command, i)
+			value := []byte(fmt.Sprintf("test_%s_%s_value_%d", testcase.protocol, testcase.command, i))
+			if err := testcase.client.Set(&Item{Key: key, Value: value}); err != nil {
+				t.Fatalf("set error: %v", err)
+			}
+			keys = append(keys, key)
+			expect[key] = value
+		}
+		result := make(map[string][]byte, num)
+		err := testcase.client.MultiGetFunc(keys, func(key string, value []byte, flags uint32) {
+			result[key] = append([]byte(nil), value...)
+		})
+		if err != nil {
+			t.Fatalf("MultiGetFunc %s error: %v", testcase.protocol, err)
+		}
+		for k, v := range expect {
+			if !bytes.Equal(v, result[k]) {
+				t.Fatalf("MultiGetFunc %s key: %s expect: %v got: %v", testcase.protocol, k, v, result[k])
+			}
+		}
+	}
+}
+
+func TestStreamValue(t *testing.T) {
+	testcases := []TestCase{
+		{client: client, protocol: "binary", command: "stream"},
+		{client: textClient, protocol: "text", command: "stream"},
+	}
+	for _, testcase := range testcases {
+		flags := uint32(1000)
+		key := fmt.Sprintf("test_%s_%s_key", testcase.protocol, testcase.command)
+		value := bytes.Repeat([]byte(fmt.Sprintf("test_%s_%s_value", testcase.protocol, testcase.command)), 10000)
+		if err := testcase.client.SetFromReader(key, int64(len(value)), bytes.NewReader(value), flags, 0); err != nil {
+			t.Fatalf("client %s SetFromReader error: %v", testcase.protocol, err)
+		}
+		buffer := new(bytes.Buffer)
+		f, err := testcase.client.GetToWriter(key, buffer)
+		if err != nil {
+			t.Fatalf("client %s GetToWriter error: %v", testcase.protocol, err)
+		}
+		if !bytes.Equal(value, buffer.Bytes()) {
+			t.Fatalf("client %s GetToWriter value expect %d bytes but got %d bytes", testcase.protocol, len(value), buffer.Len())
+		}
+		if flags != f {
+			t.Fatalf("client %s GetToWriter flags expect: %v but got: %v", testcase.protocol, flags, f)
+		}
+		if _, err = testcase.client.GetToWriter(key+"_missing", buffer); err != ErrItemNotFound {
+			t.Fatalf("client %s GetToWriter missing key expect: %v but got: %v", testcase.protocol, ErrItemNotFound, err)
+		}
+		// the connection is still usable after a miss
+		if _, err = testcase.client.GetToWriter(key, new(bytes.Buffer)); err != nil {
+			t.Fatalf("client %s GetToWriter error: %v", testcase.protocol, err)
+		}
+		if err = testcase.client.SetFromReader(key, -1, bytes.NewReader(value), flags, 0); err != ErrInvalidSize {
+			t.Fatalf("client %s SetFromReader negative size expect: %v but got: %v", testcase.protocol, ErrInvalidSize, err)
+		}
+		// sizes overflowing the body length of binary packets
+		if testcase.protocol == "binary" {
+			if err = testcase.client.SetFromReader(key, math.MaxUint32, bytes.NewReader(value), flags, 0); err != ErrInvalidSize {
+				t.Fatalf("client %s SetFromReader size overflow expect: %v but got: %v", testcase.protocol, ErrInvalidSize, err)
+			}
+		}
+	}
+}
+
+func TestChunkedValue(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		c.SetChunkSize(1000)
+		flags := uint32(1000)
+		key := fmt.Sprintf("test_%s_chunked_key", protocol)
+		value := bytes.Repeat([]byte(fmt.Sprintf("test_%s_chunked_value", protocol)), 1000)
+		if err := c.Set(&Item{Key: key, Value: value, Flags: flags}); err != nil {
+			t.Fatalf("client %s set chunked value error: %v", protocol, err)
+		}
+		item, err := c.Gets(key)
+		if err != nil {
+			t.Fatalf("client %s gets chunked value error: %v", protocol, err)
+		}
+		if item == nil || !bytes.Equal(value, item.Value) || item.Flags != flags {
+			t.Fatalf("client %s chunked value expect %d bytes with flags %d but got: %v", protocol, len(value), flags, item)
+		}
+		// a client reads chunked values once chunking is enabled, whatever its size
+		reader := newTestClient(t, protocol, testServers...)
+		reader.SetChunkSize(1)
+		items, err := reader.MultiGet([]string{key})
+		if err != nil || len(items) != 1 || !bytes.Equal(value, items[0].Value) {
+			t.Fatalf("client %s MultiGet chunked value error: %v", protocol, err)
+		}
+		result, f, err := c.GetInto(key, nil)
+		if err != nil || !bytes.Equal(value, result) || f != flags {
+			t.Fatalf("client %s GetInto chunked value error: %v", protocol, err)
+		}
+		buffer := new(bytes.Buffer)
+		if _, err = c.GetToWriter(key, buffer); err != nil || !bytes.Equal(value, buffer.Bytes()) {
+			t.Fatalf("client %s GetToWriter chunked value error: %v", protocol, err)
+		}
+		item.Value = []byte("small value")
+		if err = c.CAS(item); err != nil {
+			t.Fatalf("client %s cas chunked value error: %v", protocol, err)
+		}
+		if item, err = c.Get(key); err != nil || item == nil || string(item.Value) != "small value" {
+			t.Fatalf("client %s get after cas expect small value but got: %v, %v", protocol, item, err)
+		}
+		if err = c.Set(&Item{Key: key, Value: value, Flags: 1 << 31}); err != ErrReservedFlags {
+			t.Fatalf("client %s set reserved flags expect: %v but got: %v", protocol, ErrReservedFlags, err)
+		}
+		if err = reader.Set(&Item{Key: key, Value: make([]byte, maxChunks+1)}); err != ErrTooManyChunks {
+			t.Fatalf("client %s set too many chunks expect: %v but got: %v", protocol, ErrTooManyChunks, err)
+		}
+		long := strings.Repeat("k", maxChunkKeyLength+1)
+		if err = c.Set(&Item{Key: long, Value: value}); err != ErrChunkKeyTooLong {
+			t.Fatalf("client %s set chunked value of long key expect: %v but got: %v", protocol, ErrChunkKeyTooLong, err)
+		}
+	})
+}
+
+func TestCompression(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		c.SetCompression(100)
+		c.SetChunkSize(1000)
+		flags := uint32(1000)
+		values := map[string][]byte{
+			fmt.Sprintf("test_%s_compressed_key", protocol):     bytes.Repeat([]byte("compressed"), 1000),
+			fmt.Sprintf("test_%s_incompressible_key", protocol): []byte("too short to compress"),
+		}
+		keys := make([]string, 0, len(values))
+		for key, value := range values {
+			if err := c.Set(&Item{Key: key, Value: value, Flags: flags}); err != nil {
+				t.Fatalf("client %s set error: %v", protocol, err)
+			}
+			item, err := c.Get(key)
+			if err != nil || item == nil || !bytes.Equal(value, item.Value) || item.Flags != flags {
+				t.Fatalf("client %s get compressed value expect %d bytes but got: %v, %v", protocol, len(value), item, err)
+			}
+			keys = append(keys, key)
+		}
+		items, err := c.MultiGet(keys)
+		if err != nil || len(items) != len(values) {
+			t.Fatalf("client %s MultiGet compressed values error: %v", protocol, err)
+		}
+		for _, item := range items {
+			if !bytes.Equal(values[item.Key], item.Value) {
+				t.Fatalf("client %s MultiGet key %s expect %d bytes but got %d bytes", protocol, item.Key, len(values[item.Key]), len(item.Value))
+			}
+		}
+	})
+}
+
+func TestObject(t *testing.T) {
+	type object struct {
+		Name  string
+		Count int
+	}
+	testcases := []TestCase{
+		{client: client, protocol: "binary", command: "object"},
+		{client: textClient, protocol: "text", command: "object"},
+	}
+	for _, testcase := range testcases {
+		key := fmt.Sprintf("test_%s_%s_key", testcase.protocol, testcase.command)
+		values := []interface{}{[]byte("bytes"), "string", int64(-42), object{Name: "json", Count: 1}}
+		for _, value := range values {
+			if err := testcase.client.SetObject(key, value, 0); err != nil {
+				t.Fatalf("client %s SetObject %T error: %v", testcase.protocol, value, err)
+			}
+			result := reflect.New(reflect.TypeOf(value))
+			if err := testcase.client.GetObject(key, result.Interface()); err != nil {
+				t.Fatalf("client %s GetObject %T error: %v", testcase.protocol, value, err)
+			}
+			if !reflect.DeepEqual(value, result.Elem().Interface()) {
+				t.Fatalf("client %s GetObject expect: %v but got: %v", testcase.protocol, value, result.Elem())
+			}
+		}
+		c := newTestClient(t, testcase.protocol, testServers...)
+		if err := c.SetCodec(FlagsGob); err != nil {
+			t.Fatalf("client %s SetCodec error: %v", testcase.protocol, err)
+		}
+		if err := c.SetObject(key, object{Name: "gob", Count: 2}, 0); err != nil {
+			t.Fatalf("client %s SetObject gob error: %v", testcase.protocol, err)
+		}
+		var v object
+		if err := testcase.client.GetObject(key, &v); err != nil || v.Name != "gob" || v.Count != 2 {
+			t.Fatalf("client %s GetObject gob expect: {gob 2} but got: %v, %v", testcase.protocol, v, err)
+		}
+		if err := testcase.client.GetObject(key+"_missing", &v); err != ErrItemNotFound {
+			t.Fatalf("client %s GetObject missing key expect: %v but got: %v", testcase.protocol, ErrItemNotFound, err)
+		}
+	}
+}
+
+func TestTyped(t *testing.T) {
+	type object struct {
+		Name  string
+		Count int
+	}
+	testcases := []TestCase{
+		{client: client, protocol: "binary", command: "typed"},
+		{client: textClient, protocol: "text", command: "typed"},
+	}
+	for _, testcase := range testcases {
+		typed, err := NewTyped[object](testcase.client, FlagsJSON)
+		if err != nil {
+			t.Fatalf("client %s NewTyped error: %v", testcase.protocol, err)
+		}
+		expect := make(map[string]object)
+		keys := make([]string, 0, 3)
+		for i := 0; i < 3; i++ {
+			key := fmt.Sprintf("test_%s_%s_key_%d", testcase.protocol, testcase.command, i)
+			value := object{Name: key, Count: i}
+			if err = typed.Set(key, value, time.Minute); err != nil {
+				t.Fatalf("client %s typed set error: %v", testcase.protocol, err)
+			}
+			keys = append(keys, key)
+			expect[key] = value
+		}
+		if err = typed.Set(keys[0], expect[keys[0]], -time.Minute); err != ErrInvalidExpiration {
+			t.Fatalf("client %s typed set negative ttl expect: %v but got: %v", testcase.protocol, ErrInvalidExpiration, err)
+		}
+		value, ok, err := typed.Get(keys[1])
+		if err != nil || !ok || value != expect[keys[1]] {
+			t.Fatalf("client %s typed get expect: %v but got: %v, %v, %v", testcase.protocol, expect[keys[1]], value, ok, err)
+		}
+		if _, ok, err = typed.Get(keys[1] + "_missing"); err != nil || ok {
+			t.Fatalf("client %s typed get missing key expect not found but got: %v, %v", testcase.protocol, ok, err)
+		}
+		values, err := typed.GetMulti(keys)
+		if err != nil || !reflect.DeepEqual(expect, values) {
+			t.Fatalf("client %s typed GetMulti expect: %v but got: %v, %v", testcase.protocol, expect, values, err)
+		}
+		loaded, err := typed.GetOrLoad(context.Background(), keys[0], time.Minute, func(ctx context.Context) (object, error) {
+			return object{}, fmt.Errorf("loader shouldn't be called on a hit")
+		})
+		if err != nil || loaded != expect[keys[0]] {
+			t.Fatalf("client %s typed GetOrLoad expect: %v but got: %v, %v", testcase.protocol, expect[keys[0]], loaded, err)
+		}
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+	testcases := []TestCase{
+		{client: client, protocol: "binary", command: "get_or_load"},
+		{client: textClient, protocol: "text", command: "get_or_load"},
+	}
+	for _, testcase := range testcases {
+		key := fmt.Sprintf("test_%s_%s_key", testcase.protocol, testcase.command)
+		value := []byte(fmt.Sprintf("test_%s_%s_value", testcase.protocol, testcase.command))
+		testcase.client.SetNoreply(false)
+		if err := testcase.client.Delete(key); err != nil && err != ErrItemNotFound {
+			t.Fatalf("client %s delete error: %v", testcase.protocol, err)
+		}
+		var loads int32
+		loader := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt32(&loads, 1)
+			time.Sleep(50 * time.Millisecond)
+			return value, nil
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result, err := testcase.client.GetOrLoad(context.Background(), key, time.Minute, loader)
+				if err != nil || !bytes.Equal(value, result) {
+					t.Errorf("client %s GetOrLoad expect: %s but got: %s, %v", testcase.protocol, value, result, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if loads != 1 {
+			t.Fatalf("client %s GetOrLoad expect loader called once but got: %d", testcase.protocol, loads)
+		}
+		item, err := testcase.client.Get(key)
+		if err != nil || item == nil || !bytes.Equal(value, item.Value) {
+			t.Fatalf("client %s GetOrLoad should store the value but got: %v, %v", testcase.protocol, item, err)
+		}
+	}
+}
+
+func TestGetOrLoadWithLock(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		c.SetLoadLock(time.Second)
+		key := fmt.Sprintf("test_%s_load_lock_key", protocol)
+		value := []byte(fmt.Sprintf("test_%s_load_lock_value", protocol))
+		if err := c.Delete(key); err != nil && err != ErrItemNotFound {
+			t.Fatalf("client %s delete error: %v", protocol, err)
+		}
+		// another process holds the lock and fills the value later
+		if err := c.Set(&Item{Key: key + ":lock", Value: []byte("1"), Expiration: 1}); err != nil {
+			t.Fatalf("client %s set lock error: %v", protocol, err)
+		}
+		done := make(chan struct{})
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			c.Set(&Item{Key: key, Value: value})
+			close(done)
+		}()
+		result, err := c.GetOrLoad(context.Background(), key, time.Minute, func(ctx context.Context) ([]byte, error) {
+			return nil, fmt.Errorf("loader shouldn't be called while the lock is held")
+		})
+		<-done
+		if err != nil || !bytes.Equal(value, result) {
+			t.Fatalf("client %s GetOrLoad with lock expect: %s but got: %s, %v", protocol, value, result, err)
+		}
+	})
+}
+
+func TestGetOrLoadEarlyExpiration(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		c.SetEarlyExpiration(1)
+		key := fmt.Sprintf("test_%s_early_expiration_key", protocol)
+		if err := c.Delete(key); err != nil && err != ErrItemNotFound {
+			t.Fatalf("client %s delete error: %v", protocol, err)
+		}
+		var loads int32
+		loader := func(ctx context.Context) ([]byte, error) {
+			n := atomic.AddInt32(&loads, 1)
+			time.Sleep(time.Millisecond)
+			return []byte(fmt.Sprintf("value_%d", n)), nil
+		}
+		if _, err := c.GetOrLoad(context.Background(), key, time.Minute, loader); err != nil {
+			t.Fatalf("client %s GetOrLoad error: %v", protocol, err)
+		}
+		// plain readers get the value without the envelope
+		plain := newTestClient(t, protocol, testServers...)
+		item, err := plain.Get(key)
+		if err != nil || item == nil || string(item.Value) != "value_1" || item.Flags != 0 {
+			t.Fatalf("client %s plain get expect: value_1 but got: %v, %v", protocol, item, err)
+		}
+		if value, _ := c.GetOrLoad(context.Background(), key, time.Minute, loader); string(value) != "value_1" {
+			t.Fatalf("client %s GetOrLoad far from expiration expect: value_1 but got: %s", protocol, value)
+		}
+		now := time.Now()
+		setNow(t, now.Add(time.Minute))
+		value, err := c.GetOrLoad(context.Background(), key, time.Minute, loader)
+		nowFunc = time.Now
+		if err != nil || string(value) != "value_2" {
+			t.Fatalf("client %s GetOrLoad near expiration expect: value_2 but got: %s, %v", protocol, value, err)
+		}
+	})
+}
+
+func TestGetOrLoadStaleWhileRevalidate(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		refreshErrors := make(chan error, 1)
+		c.SetStaleWhileRevalidate(time.Minute, func(key string, err error) {
+			refreshErrors <- err
+		})
+		key := fmt.Sprintf("test_%s_stale_key", protocol)
+		if err := c.Delete(key); err != nil && err != ErrItemNotFound {
+			t.Fatalf("client %s delete error: %v", protocol, err)
+		}
+		var loads int32
+		loader := func(ctx context.Context) ([]byte, error) {
+			n := atomic.AddInt32(&loads, 1)
+			if n == 3 {
+				return nil, fmt.Errorf("load error")
+			}
+			return []byte(fmt.Sprintf("value_%d", n)), nil
+		}
+		if _, err := c.GetOrLoad(context.Background(), key, time.Minute, loader); err != nil {
+			t.Fatalf("client %s GetOrLoad error: %v", protocol, err)
+		}
+		waitRefresh := func() {
+			for {
+				c.refreshMu.Lock()
+				n := len(c.refreshing)
+				c.refreshMu.Unlock()
+				if n == 0 {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		now := time.Now()
+		setNow(t, now.Add(time.Minute+time.Second))
+		value, err := c.GetOrLoad(context.Background(), key, time.Minute, loader)
+		waitRefresh()
+		if err != nil || string(value) != "value_1" {
+			t.Fatalf("client %s GetOrLoad stale value expect: value_1 but got: %s, %v", protocol, value, err)
+		}
+		item, err := c.Get(key)
+		if err != nil || item == nil || string(item.Value) != "value_2" {
+			t.Fatalf("client %s value should be refreshed to value_2 but got: %v, %v", protocol, item, err)
+		}
+		setNow(t, now.Add(2*time.Minute+time.Second))
+		value, _ = c.GetOrLoad(context.Background(), key, time.Minute, loader)
+		waitRefresh()
+		nowFunc = time.Now
+		if string(value) != "value_2" {
+			t.Fatalf("client %s GetOrLoad stale value expect: value_2 but got: %s", protocol, value)
+		}
+		select {
+		case err = <-refreshErrors:
+		default:
+			t.Fatalf("client %s refresh error should be reported", protocol)
+		}
+	})
+}
+
+func TestBatchGet(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		c.SetBatching(time.Millisecond, 4)
+		num := 10
+		for i := 0; i < num; i++ {
+			key := fmt.Sprintf("test_%s_batch_key_%d", protocol, i)
+			value := []byte(fmt.Sprintf("test_%s_batch_value_%d", protocol, i))
+			if err := c.Set(&Item{Key: key, Value: value}); err != nil {
+				t.Fatalf("client %s set error: %v", protocol, err)
+			}
+		}
+		var wg sync.WaitGroup
+		errs := make(chan error, 2*num+1)
+		for i := 0; i < 2*num+1; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				// half of the keys are requested twice and the last one is missing
+				key := fmt.Sprintf("test_%s_batch_key_%d", protocol, i%(num+1))
+				item, err := c.Get(key)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if i%(num+1) == num {
+					if item != nil {
+						errs <- fmt.Errorf("key %s expect miss but got: %v", key, item)
+					}
+					return
+				}
+				value := fmt.Sprintf("test_%s_batch_value_%d", protocol, i%(num+1))
+				if item == nil || string(item.Value) != value {
+					errs <- fmt.Errorf("key %s expect: %s but got: %v", key, value, item)
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("client %s batch get error: %v", protocol, err)
+		}
+	})
+}
+
+func TestLease(t *testing.T) {
+	meta := newTestClient(t, "meta", testServers...)
+	if _, err := client.GetLease("test_lease_key"); err != ErrOperationNotSupported {
+		t.Fatalf("client binary GetLease expect: %v but got: %v", ErrOperationNotSupported, err)
+	}
+	// leases of MemoryCache follow memcached in meta protocol
+	for name, c := range map[string]Cacher{"meta": meta, "memory": NewMemoryCache()} {
+		key := "test_lease_key"
+		c.Delete(key)
+		won, err := c.GetLease(key)
+		if err != nil {
+			t.Fatalf("cacher %s GetLease error: %v", name, err)
+		}
+		if !won.Won || won.Item != nil {
+			t.Fatalf("cacher %s GetLease of missing key expect won without item but got: %+v", name, won)
+		}
+		lost, err := c.GetLease(key)
+		if err != nil {
+			t.Fatalf("cacher %s GetLease error: %v", name, err)
+		}
+		if lost.Won || !lost.Pending || lost.Item != nil {
+			t.Fatalf("cacher %s second GetLease expect pending without item but got: %+v", name, lost)
+		}
+		if err = c.SetWithLease(&Item{Key: key, Value: []byte("v1")}, lost); err != ErrLeaseNotWon {
+			t.Fatalf("cacher %s SetWithLease with lost lease expect: %v but got: %v", name, ErrLeaseNotWon, err)
+		}
+		if err = c.SetWithLease(&Item{Key: key, Value: []byte("v1")}, won); err != nil {
+			t.Fatalf("cacher %s SetWithLease error: %v", name, err)
+		}
+		item, err := c.Get(key)
+		if err != nil || item == nil || string(item.Value) != "v1" {
+			t.Fatalf("cacher %s Get after SetWithLease expect: v1 but got: %v, %v", name, item, err)
+		}
+
+		if err = c.Invalidate(key); err != nil {
+			t.Fatalf("cacher %s Invalidate error: %v", name, err)
+		}
+		won, err = c.GetLease(key)
+		if err != nil {
+			t.Fatalf("cacher %s GetLease error: %v", name, err)
+		}
+		if !won.Won || !won.Stale || won.Item == nil || string(won.Item.Value) != "v1" {
+			t.Fatalf("cacher %s GetLease of stale key expect won with stale item but got: %+v", name, won)
+		}
+		lost, err = c.GetLease(key)
+		if err != nil {
+			t.Fatalf("cacher %s GetLease error: %v", name, err)
+		}
+		if lost.Won || !lost.Stale || lost.Item == nil || string(lost.Item.Value) != "v1" {
+			t.Fatalf("cacher %s second GetLease of stale key expect stale item but got: %+v", name, lost)
+		}
+		if err = c.SetWithLease(&Item{Key: key, Value: []byte("v2")}, won); err != nil {
+			t.Fatalf("cacher %s SetWithLease error: %v", name, err)
+		}
+		// the lease is invalid once the key changes
+		if err = c.SetWithLease(&Item{Key: key, Value: []byte("v3")}, won); err != ErrItemExists {
+			t.Fatalf("cacher %s SetWithLease with old lease expect: %v but got: %v", name, ErrItemExists, err)
+		}
+		lease, err := c.GetLease(key)
+		if err != nil {
+			t.Fatalf("cacher %s GetLease error: %v", name, err)
+		}
+		if lease.Won || lease.Stale || lease.Item == nil || string(lease.Item.Value) != "v2" {
+			t.Fatalf("cacher %s GetLease expect fresh item v2 but got: %+v", name, lease)
+		}
+		if err = c.Invalidate("test_lease_missing_key"); err != ErrItemNotFound {
+			t.Fatalf("cacher %s Invalidate missing key expect: %v but got: %v", name, ErrItemNotFound, err)
+		}
+	}
+}
+
+func TestNearCache(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		c.SetNearCache(64, time.Minute)
+		other := newTestClient(t, protocol, testServers...)
+		key := fmt.Sprintf("test_%s_near_key", protocol)
+		if err := c.Set(&Item{Key: key, Value: []byte("v1")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		if item, err := c.Get(key); err != nil || item == nil || string(item.Value) != "v1" {
+			t.Fatalf("client %s get expect: v1 but got: %v, %v", protocol, item, err)
+		}
+		// changes by other clients are not seen until ttl
+		if err := other.Set(&Item{Key: key, Value: []byte("v2")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		item, err := c.Get(key)
+		if err != nil || item == nil || string(item.Value) != "v1" {
+			t.Fatalf("client %s near get expect: v1 but got: %v, %v", protocol, item, err)
+		}
+		// cached values can't be modified by callers
+		item.Value[0] = 'x'
+		items, err := c.MultiGet([]string{key})
+		if err != nil || len(items) != 1 || string(items[0].Value) != "v1" {
+			t.Fatalf("client %s near multi get expect: v1 but got: %v, %v", protocol, items, err)
+		}
+		// reads reusing buffers agree with Get
+		if value, _, err := c.GetInto(key, nil); err != nil || string(value) != "v1" {
+			t.Fatalf("client %s near get into expect: v1 but got: %s, %v", protocol, value, err)
+		}
+		now := time.Now()
+		setNow(t, now.Add(time.Minute))
+		item, err = c.Get(key)
+		nowFunc = time.Now
+		if err != nil || item == nil || string(item.Value) != "v2" {
+			t.Fatalf("client %s get after ttl expect: v2 but got: %v, %v", protocol, item, err)
+		}
+		// local writes invalidate the near cache
+		if err = c.Set(&Item{Key: key, Value: []byte("v3")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		if item, err = c.Get(key); err != nil || item == nil || string(item.Value) != "v3" {
+			t.Fatalf("client %s get after set expect: v3 but got: %v, %v", protocol, item, err)
+		}
+		if err = c.Delete(key); err != nil {
+			t.Fatalf("client %s delete error: %v", protocol, err)
+		}
+		if item, err = c.Get(key); err != nil || item != nil {
+			t.Fatalf("client %s get after delete expect miss but got: %v, %v", protocol, item, err)
+		}
+		// least recently used items are evicted beyond maxBytes
+		keys := make([]string, 0, 4)
+		for i := 0; i < 4; i++ {
+			k := fmt.Sprintf("test_%s_near_key_%d", protocol, i)
+			if err = c.Set(&Item{Key: k, Value: []byte("value")}); err != nil {
+				t.Fatalf("client %s set error: %v", protocol, err)
+			}
+			keys = append(keys, k)
+		}
+		if items, err = c.MultiGet(keys); err != nil || len(items) != 4 {
+			t.Fatalf("client %s multi get expect 4 items but got: %v, %v", protocol, items, err)
+		}
+		if c.near.size > 64 || len(c.near.entries) != 2 {
+			t.Fatalf("client %s near cache expect 2 entries within 64 bytes but got %d entries of %d bytes", protocol, len(c.near.entries), c.near.size)
+		}
+	})
+}
+
+func TestIncrement(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		key := fmt.Sprintf("test_%s_incr_key", protocol)
+		c.Delete(key)
+		if _, err := c.Increment(key, 1); err != ErrItemNotFound {
+			t.Fatalf("client %s increment missing key expect: %v but got: %v", protocol, ErrItemNotFound, err)
+		}
+		item := &Item{Key: key, Value: []byte("10")}
+		if err := c.Set(item); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		if string(item.Value) != "10" {
+			t.Fatalf("client %s set expect value unchanged but got: %q", protocol, item.Value)
+		}
+		if value, err := c.Increment(key, 15); err != nil || value != 25 {
+			t.Fatalf("client %s increment expect: 25 but got: %d, %v", protocol, value, err)
+		}
+		if value, err := c.Decrement(key, 5); err != nil || value != 20 {
+			t.Fatalf("client %s decrement expect: 20 but got: %d, %v", protocol, value, err)
+		}
+		if value, err := c.Decrement(key, 100); err != nil || value != 0 {
+			t.Fatalf("client %s decrement expect: 0 but got: %d, %v", protocol, value, err)
+		}
+		if item, err := c.Get(key); err != nil || item == nil || string(item.Value) != "0" {
+			t.Fatalf("client %s get expect: 0 but got: %v, %v", protocol, item, err)
+		}
+	})
+}
+
+func TestNamespace(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		name := fmt.Sprintf("test_%s_namespace", protocol)
+		ns := NewNamespace(c, name, time.Minute)
+		other := NewNamespace(c, name, time.Minute)
+		keys := []string{"key1", "key2"}
+		for _, key := range keys {
+			if err := ns.Set(&Item{Key: key, Value: []byte(key)}); err != nil {
+				t.Fatalf("client %s namespace set error: %v", protocol, err)
+			}
+		}
+		item, err := other.Get("key1")
+		if err != nil || item == nil || item.Key != "key1" || string(item.Value) != "key1" {
+			t.Fatalf("client %s namespace get expect: key1 but got: %v, %v", protocol, item, err)
+		}
+		items, err := ns.MultiGet(keys)
+		if err != nil || len(items) != 2 {
+			t.Fatalf("client %s namespace multi get expect 2 items but got: %v, %v", protocol, items, err)
+		}
+		for _, item := range items {
+			if item.Key != string(item.Value) {
+				t.Fatalf("client %s namespace multi get expect key %s but got: %s", protocol, item.Value, item.Key)
+			}
+		}
+		if err = ns.Invalidate(); err != nil {
+			t.Fatalf("client %s namespace invalidate error: %v", protocol, err)
+		}
+		if items, err = ns.MultiGet(keys); err != nil || len(items) != 0 {
+			t.Fatalf("client %s namespace multi get after invalidate expect miss but got: %v, %v", protocol, items, err)
+		}
+		// other namespaces see the new generation after ttl
+		if item, err = other.Get("key1"); err != nil || item == nil {
+			t.Fatalf("client %s namespace get expect cached generation but got: %v, %v", protocol, item, err)
+		}
+		now := time.Now()
+		setNow(t, now.Add(time.Minute))
+		item, err = other.Get("key1")
+		nowFunc = time.Now
+		if err != nil || item != nil {
+			t.Fatalf("client %s namespace get after ttl expect miss but got: %v, %v", protocol, item, err)
+		}
+		if err = ns.Set(&Item{Key: "key1", Value: []byte("value")}); err != nil {
+			t.Fatalf("client %s namespace set error: %v", protocol, err)
+		}
+		if err = ns.Delete("key1"); err != nil {
+			t.Fatalf("client %s namespace delete error: %v", protocol, err)
+		}
+		if item, err = ns.Get("key1"); err != nil || item != nil {
+			t.Fatalf("client %s namespace get after delete expect miss but got: %v, %v", protocol, item, err)
+		}
+	})
+}
+
+func TestKeyTransformer(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		plain := newTestClient(t, protocol, testServers...)
+		prefix := fmt.Sprintf("test_%s_service:", protocol)
+		c.SetKeyTransformer(ChainKeys(PrefixKeys(prefix), HashLongKeys(0)))
+		long := string(bytes.Repeat([]byte("k"), 300))
+		keys := []string{"key", "key with spaces", long}
+		for _, key := range keys {
+			if err := c.Set(&Item{Key: key, Value: []byte(key)}); err != nil {
+				t.Fatalf("client %s set %q error: %v", protocol, key, err)
+			}
+			item, err := c.Get(key)
+			if err != nil || item == nil || item.Key != key || string(item.Value) != key {
+				t.Fatalf("client %s get %q expect the original key but got: %v, %v", protocol, key, item, err)
+			}
+		}
+		if item, err := plain.Get(prefix + "key"); err != nil || item == nil || string(item.Value) != "key" {
+			t.Fatalf("client %s get prefixed key expect: key but got: %v, %v", protocol, item, err)
+		}
+		items, err := c.MultiGet(keys)
+		if err != nil || len(items) != len(keys) {
+			t.Fatalf("client %s multi get expect %d items but got: %v, %v", protocol, len(keys), items, err)
+		}
+		for _, item := range items {
+			if item.Key != string(item.Value) {
+				t.Fatalf("client %s multi get expect key %q but got: %q", protocol, item.Value, item.Key)
+			}
+		}
+		err = c.MultiGetFunc(keys, func(key string, value []byte, flags uint32) {
+			if key != string(value) {
+				t.Errorf("client %s multi get func expect key %q but got: %q", protocol, value, key)
+			}
+		})
+		if err != nil {
+			t.Fatalf("client %s multi get func error: %v", protocol, err)
+		}
+		for _, key := range keys {
+			if err = c.Delete(key); err != nil {
+				t.Fatalf("client %s delete %q error: %v", protocol, key, err)
+			}
+			if item, err := c.Get(key); err != nil || item != nil {
+				t.Fatalf("client %s get %q after delete expect miss but got: %v, %v", protocol, key, item, err)
+			}
+		}
+
+		c.SetKeyTransformer(Base64Keys())
+		key := "binary\x00\xffkey"
+		if err = c.Set(&Item{Key: key, Value: []byte("value")}); err != nil {
+			t.Fatalf("client %s set binary key error: %v", protocol, err)
+		}
+		if item, err := c.Get(key); err != nil || item == nil || item.Key != key || string(item.Value) != "value" {
+			t.Fatalf("client %s get binary key expect: value but got: %v, %v", protocol, item, err)
+		}
+		c.SetKeyTransformer(nil)
+		if _, err = c.Get(long); err != ErrInvalidKey {
+			t.Fatalf("client %s get long key expect: %v but got: %v", protocol, ErrInvalidKey, err)
+		}
+	})
+}
+
+func TestHashLongKeysXXHash(t *testing.T) {
+	vectors := map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"a":   0xd24ec4f1a98c6e5b,
+		"abc": 0x44bc2cf5ad770999,
+		"Nobody inspects the spammish repetition": 0xfbcea83c8a378bf1,
+	}
+	for input, expected := range vectors {
+		if sum := xxhash64([]byte(input)); sum != expected {
+			t.Fatalf("xxhash64 of %q expect: %x but got: %x", input, expected, sum)
+		}
+	}
+	transformer := HashLongKeysXXHash(0)
+	if key := transformer.TransformKey("key"); key != "key" {
+		t.Fatalf("xxhash short key expect: key but got: %s", key)
+	}
+	long := string(bytes.Repeat([]byte("k"), 300))
+	key := transformer.TransformKey(long)
+	expected := long[:maxKeyLength-17] + ":" + fmt.Sprintf("%016x", xxhash64([]byte(long)))
+	if key != expected || len(key) != maxKeyLength {
+		t.Fatalf("xxhash long key expect: %s but got: %s", expected, key)
+	}
+	if key = transformer.TransformKey("key with spaces"); key != "key:"+fmt.Sprintf("%016x", xxhash64([]byte("key with spaces"))) {
+		t.Fatalf("xxhash key with spaces got: %s", key)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	now := time.Now()
+	day := uint32(60 * 60 * 24)
+	setNow(t, now)
+	cases := []struct {
+		item       *Item
+		expiration uint32
+		err        error
+	}{
+		{&Item{}, 0, nil},
+		{&Item{Expiration: 60}, 60, nil},
+		{&Item{Expiration: 60 * day}, 0, ErrInvalidExpiration},
+		{&Item{Expiration: uint32(now.Unix()) + 60}, uint32(now.Unix()) + 60, nil},
+		{&Item{TTL: 1500 * time.Millisecond}, 2, nil},
+		{&Item{TTL: 60 * 24 * time.Hour}, uint32(now.Unix()) + 60*day, nil},
+		{&Item{TTL: -time.Second}, 0, ErrInvalidExpiration},
+		{&Item{ExpiresAt: now.Add(time.Minute)}, 60, nil},
+		{&Item{ExpiresAt: now.Add(60 * 24 * time.Hour)}, uint32(now.Unix()) + 60*day, nil},
+		{&Item{ExpiresAt: now.Add(-time.Minute)}, 0, ErrInvalidExpiration},
+		{&Item{Expiration: 60, TTL: time.Minute}, 0, ErrInvalidExpiration},
+		{&Item{TTL: time.Minute, ExpiresAt: now.Add(time.Minute)}, 0, ErrInvalidExpiration},
+	}
+	for _, c := range cases {
+		expiration, err := itemExpiration(c.item)
+		if expiration != c.expiration || err != c.err {
+			t.Fatalf("expiration of %+v expect: %d, %v but got: %d, %v", c.item, c.expiration, c.err, expiration, err)
+		}
+	}
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		key := fmt.Sprintf("test_%s_expiration_key", protocol)
+		item := &Item{Key: key, Value: []byte("value"), TTL: 60 * 24 * time.Hour}
+		if err := c.Set(item); err != nil {
+			t.Fatalf("client %s set with ttl error: %v", protocol, err)
+		}
+		if item.TTL != 60*24*time.Hour || item.Expiration != 0 {
+			t.Fatalf("client %s set expect item unchanged but got: %+v", protocol, item)
+		}
+		if result, err := c.Get(key); err != nil || result == nil {
+			t.Fatalf("client %s get expect item but got: %v, %v", protocol, result, err)
+		}
+		if err := c.Set(&Item{Key: key, Value: []byte("value"), Expiration: 60 * day}); err != ErrInvalidExpiration {
+			t.Fatalf("client %s set expect: %v but got: %v", protocol, ErrInvalidExpiration, err)
+		}
+	})
+}
+
+func TestServerStats(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		key := fmt.Sprintf("test_%s_stats_key", protocol)
+		if err := c.Set(&Item{Key: key, Value: []byte("value")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		c.Get(key)
+		results, err := c.ServerStats("")
+		if err != nil {
+			t.Fatalf("client %s stats error: %v", protocol, err)
+		}
+		if len(results) != len(testServers) {
+			t.Fatalf("client %s stats expect %d servers but got: %v", protocol, len(testServers), results)
+		}
+		var items, hits uint64
+		for _, server := range testServers {
+			stats := Stats(results[server])
+			if stats["version"] == "" {
+				t.Fatalf("client %s stats of %s expect version but got: %v", protocol, server, stats)
+			}
+			if ratio := stats.HitRatio(); ratio < 0 || ratio > 1 {
+				t.Fatalf("client %s hit ratio of %s expect in [0, 1] but got: %f", protocol, server, ratio)
+			}
+			items += stats.CurrItems()
+			hits += stats.Uint64("get_hits")
+			if stats.CurrItems() != 0 && stats.Bytes() == 0 {
+				t.Fatalf("client %s stats of %s expect bytes but got: %v", protocol, server, stats)
+			}
+		}
+		if items == 0 || hits == 0 {
+			t.Fatalf("client %s stats expect items and hits but got: %d, %d", protocol, items, hits)
+		}
+		if results, err = c.ServerStats("settings"); err != nil || len(results[testServers[0]]) == 0 {
+			t.Fatalf("client %s settings stats expect results but got: %v, %v", protocol, results, err)
+		}
+		_, err = c.ServerStats("unknown_group")
+		if errs, ok := err.(ServerErrors); !ok || len(errs) != len(testServers) {
+			t.Fatalf("client %s unknown stats expect errors of every server but got: %v", protocol, err)
+		}
+		if _, err = c.ServerStats("bad\r\ngroup"); err != ErrInvalidKey {
+			t.Fatalf("client %s stats expect: %v but got: %v", protocol, ErrInvalidKey, err)
+		}
+		// groups with arguments are sent as is
+		for _, group := range []string{"detail on", "detail dump", "detail off"} {
+			if _, err = c.ServerStats(group); err != nil {
+				t.Fatalf("client %s stats %s error: %v", protocol, group, err)
+			}
+		}
+		if protocol == "text" {
+			results, err = c.ServerStats("cachedump 1 0")
+			dumped := 0
+			for _, stats := range results {
+				dumped += len(stats)
+			}
+			if err != nil || dumped == 0 {
+				t.Fatalf("client %s stats cachedump expect items but got: %d, %v", protocol, dumped, err)
+			}
+		}
+	})
+}
+
+func TestAdminCommands(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		if err := c.Ping(); err != nil {
+			t.Fatalf("client %s ping error: %v", protocol, err)
+		}
+		versions, err := c.Version()
+		if err != nil || len(versions) != len(testServers) {
+			t.Fatalf("client %s version expect %d servers but got: %v, %v", protocol, len(testServers), versions, err)
+		}
+		for server, version := range versions {
+			if version == "" {
+				t.Fatalf("client %s version of %s expect not empty", protocol, server)
+			}
+		}
+		key := fmt.Sprintf("test_%s_flush_key", protocol)
+		if err = c.Set(&Item{Key: key, Value: []byte("value")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		if err = c.FlushAll(0); err != nil {
+			t.Fatalf("client %s flush all error: %v", protocol, err)
+		}
+		if item, err := c.Get(key); err != nil || item != nil {
+			t.Fatalf("client %s get after flush all expect miss but got: %v, %v", protocol, item, err)
+		}
+
+		// the address isn't listened
+		down := "127.0.0.1:1"
+		c = newTestClient(t, protocol, append([]string{down}, testServers...)...)
+		err = c.Ping()
+		if errs, ok := err.(ServerErrors); !ok || len(errs) != 1 || errs[down] == nil {
+			t.Fatalf("client %s ping expect error of %s but got: %v", protocol, down, err)
+		}
+		versions, err = c.Version()
+		if _, ok := err.(ServerErrors); !ok || len(versions) != len(testServers) {
+			t.Fatalf("client %s version expect %d servers and errors but got: %v, %v", protocol, len(testServers), versions, err)
+		}
+	})
+}
+
+func TestHealthCheck(t *testing.T) {
+	down := "127.0.0.1:1"
+	for _, protocol := range testProtocols {
+		c := newTestClient(t, protocol, append([]string{down}, testServers...)...)
+		report := c.HealthCheck(context.Background())
+		if report.Status != HealthDegraded || len(report.Servers) != len(testServers)+1 {
+			t.Fatalf("client %s health expect degraded but got: %+v", protocol, report)
+		}
+		for _, health := range report.Servers {
+			if health.Healthy == (health.Address == down) || (health.Error != "") == health.Healthy {
+				t.Fatalf("client %s health of %s is wrong: %+v", protocol, health.Address, health)
+			}
+			if health.Healthy && (health.Latency <= 0 || health.Pool.IdleConns == 0) {
+				t.Fatalf("client %s health of %s expect latency and idle conns but got: %+v", protocol, health.Address, health)
+			}
+		}
+
+		recorder := httptest.NewRecorder()
+		c.HealthHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+		if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+			t.Fatalf("client %s decode health error: %v", protocol, err)
+		}
+		if recorder.Code != http.StatusOK || report.Status != HealthDegraded {
+			t.Fatalf("client %s health handler expect 200 and degraded but got: %d, %+v", protocol, recorder.Code, report)
+		}
+
+		c = newTestClient(t, protocol, down)
+		recorder = httptest.NewRecorder()
+		c.HealthHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Fatalf("client %s health handler expect 503 but got: %d", protocol, recorder.Code)
+		}
+	}
+}
+
+func TestFaults(t *testing.T) {
+	for _, protocol := range testProtocols {
+		proxy, err := memcachetest.NewProxy(testServers[0])
+		if err != nil {
+			t.Fatalf("start proxy error: %v", err)
+		}
+		c := newTestClient(t, protocol, proxy.Addr())
+		c.SetSocketTimeout(100 * time.Millisecond)
+		key := fmt.Sprintf("test_%s_faults_key", protocol)
+		value := bytes.Repeat([]byte("v"), 100)
+		if err = c.Set(&Item{Key: key, Value: value}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		scenarios := []struct {
+			name   string
+			faults memcachetest.Faults
+		}{
+			{"latency", memcachetest.Faults{Latency: 300 * time.Millisecond}},
+			{"reset", memcachetest.Faults{ResetAfter: 30}},
+			{"corrupt", memcachetest.Faults{Corrupt: true}},
+			{"blackhole", memcachetest.Faults{Blackhole: true}},
+			{"error", memcachetest.Faults{Error: "SERVER_ERROR out of memory\r\n"}},
+		}
+		for _, scenario := range scenarios {
+			proxy.SetFaults(scenario.faults)
+			if item, err := c.Get(key); err == nil {
+				t.Fatalf("client %s get with %s fault expect error but got: %v", protocol, scenario.name, item)
+			}
+			if _, _, err := c.GetInto(key, nil); err == nil {
+				t.Fatalf("client %s get into with %s fault expect error", protocol, scenario.name)
+			}
+			if protocol == "text" && scenario.name == "error" {
+				err = c.Set(&Item{Key: key, Value: value})
+				if _, ok := err.(ServerError); !ok {
+					t.Fatalf("client %s set with %s fault expect ServerError but got: %v", protocol, scenario.name, err)
+				}
+			}
+			proxy.SetFaults(memcachetest.Faults{})
+			// broken connections are dropped, so the next reply isn't out of sync
+			for i := 0; i < 3; i++ {
+				item, err := c.Get(key)
+				if err != nil || item == nil || !bytes.Equal(item.Value, value) {
+					t.Fatalf("client %s get after %s fault expect value but got: %v, %v", protocol, scenario.name, item, err)
+				}
+			}
+			if stats := c.protocol.poolStats(0); stats.ActiveConns != 0 {
+				t.Fatalf("client %s pool after %s fault expect no active conns but got: %+v", protocol, scenario.name, stats)
+			}
+		}
+		proxy.Close()
+	}
+}
+
+func TestErrorReplies(t *testing.T) {
+	proxy, err := memcachetest.NewProxy(testServers[0])
+	if err != nil {
+		t.Fatalf("start proxy error: %v", err)
+	}
+	defer proxy.Close()
+	c := newTestClient(t, "text", proxy.Addr())
+	// only a SERVER_ERROR reply to store commands keeps the connection
+	for _, reply := range []string{"SERVER_ERROR object too large for cache\r\n", "CLIENT_ERROR bad data chunk\r\n", "ERROR\r\n"} {
+		proxy.SetFaults(memcachetest.Faults{Error: reply})
+		if err = c.Set(&Item{Key: "test_text_error_replies_key", Value: []byte("value")}); err == nil {
+			t.Fatalf("client text set with reply %q expect error", reply)
+		}
+		kept := strings.HasPrefix(reply, "SERVER_ERROR")
+		if stats := c.protocol.poolStats(0); (stats.IdleConns == 1) != kept {
+			t.Fatalf("client text set with reply %q expect conn kept: %v but got: %+v", reply, kept, stats)
+		}
+		proxy.SetFaults(memcachetest.Faults{})
+		if err = c.Ping(); err != nil {
+			t.Fatalf("client text ping after reply %q error: %v", reply, err)
+		}
+	}
+	proxy.SetFaults(memcachetest.Faults{Error: "SERVER_ERROR out of memory\r\n"})
+	if _, err = c.MultiGet([]string{"test_text_error_replies_key"}); err == nil {
+		t.Fatalf("client text multi get with server error expect error")
+	}
+	if stats := c.protocol.poolStats(0); stats.IdleConns != 0 {
+		t.Fatalf("client text multi get with server error expect conn dropped but got: %+v", stats)
+	}
+	proxy.SetFaults(memcachetest.Faults{})
+
+	// replies of other requests left on the connection are skipped
+	buffer := new(bytes.Buffer)
+	for _, opaque := range []uint32{1, 2} {
+		pkt := &packet{header: header{magic: responseMagic, opcode: operations["getk"].opcode, keyLength: 3, bodyLength: 3, opaque: opaque}, key: "key"}
+		if err = pkt.write(buffer); err != nil {
+			t.Fatalf("write packet error: %v", err)
+		}
+	}
+	pkt := new(packet)
+	if _, err = pkt.readReply(buffer, nil, 2); err != nil || pkt.opaque != 2 || pkt.key != "key" {
+		t.Fatalf("binary read reply expect opaque 2 but got: %+v, %v", pkt.header, err)
+	}
+	if _, err = pkt.readReply(buffer, nil, 3); err == nil {
+		t.Fatalf("binary read reply of closed reader expect error")
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	client, err := NewClient(testServers)
+	if err != nil {
+		t.Fatalf("init client error: %v", err)
+	}
+	memory := NewMemoryCache()
+	// Delete of missing keys replies nil by default
+	for name, c := range map[string]Cacher{"memory": memory, "text": client} {
+		if err = c.Delete("test_cacher_noreply_missing_key"); err != nil {
+			t.Fatalf("cacher %s delete missing key with noreply error: %v", name, err)
+		}
+	}
+	client.SetNoreply(false)
+	memory.SetNoreply(false)
+	// the same semantics are expected from memcached in text protocol and MemoryCache
+	cachers := map[string]Cacher{"memory": memory, "text": client}
+	for name, c := range cachers {
+		key := fmt.Sprintf("test_%s_cacher_key", name)
+		c.Delete(key)
+		if err := c.Replace(&Item{Key: key, Value: []byte("value")}); err != ErrItemNotStored {
+			t.Fatalf("cacher %s replace missing key expect: %v but got: %v", name, ErrItemNotStored, err)
+		}
+		if err := c.CAS(&Item{Key: key, Value: []byte("value"), CAS: 1}); err != ErrItemNotFound {
+			t.Fatalf("cacher %s cas missing key expect: %v but got: %v", name, ErrItemNotFound, err)
+		}
+		if err := c.Add(&Item{Key: key, Value: []byte("1")}); err != nil {
+			t.Fatalf("cacher %s add error: %v", name, err)
+		}
+		if err := c.Add(&Item{Key: key, Value: []byte("2")}); err != ErrItemNotStored {
+			t.Fatalf("cacher %s add existing key expect: %v but got: %v", name, ErrItemNotStored, err)
+		}
+		item, err := c.Gets(key)
+		if err != nil || item == nil || string(item.Value) != "1" || item.CAS == 0 {
+			t.Fatalf("cacher %s gets expect value 1 with cas but got: %+v, %v", name, item, err)
+		}
+		if err = c.Replace(&Item{Key: key, Value: []byte("10")}); err != nil {
+			t.Fatalf("cacher %s replace error: %v", name, err)
+		}
+		item.Value = []byte("3")
+		if err = c.CAS(item); err != ErrItemExists {
+			t.Fatalf("cacher %s cas outdated item expect: %v but got: %v", name, ErrItemExists, err)
+		}
+		if item, err = c.Gets(key); err != nil || item == nil {
+			t.Fatalf("cacher %s gets expect item but got: %+v, %v", name, item, err)
+		}
+		if err = c.CAS(item); err != nil {
+			t.Fatalf("cacher %s cas error: %v", name, err)
+		}
+		if value, err := c.Increment(key, 5); err != nil || value != 15 {
+			t.Fatalf("cacher %s increment expect: 15 but got: %d, %v", name, value, err)
+		}
+		if value, err := c.Decrement(key, 20); err != nil || value != 0 {
+			t.Fatalf("cacher %s decrement expect: 0 but got: %d, %v", name, value, err)
+		}
+		items, err := c.MultiGet([]string{key, key, key + "_missing"})
+		if err != nil || len(items) != 1 || items[0].Key != key || string(items[0].Value) != "0" {
+			t.Fatalf("cacher %s multi get expect one item but got: %v, %v", name, items, err)
+		}
+		if err = c.Delete(key); err != nil {
+			t.Fatalf("cacher %s delete error: %v", name, err)
+		}
+		if err = c.Delete(key); err != ErrItemNotFound {
+			t.Fatalf("cacher %s delete missing key expect: %v but got: %v", name, ErrItemNotFound, err)
+		}
+		if item, err = c.Get(key); err != nil || item != nil {
+			t.Fatalf("cacher %s get deleted key expect nil but got: %+v, %v", name, item, err)
+		}
+		if _, err = c.Increment(key, 1); err != ErrItemNotFound {
+			t.Fatalf("cacher %s increment missing key expect: %v but got: %v", name, ErrItemNotFound, err)
+		}
+
+		if err = c.SetFromReader(key, -1, bytes.NewReader(nil), 0, 0); err != ErrInvalidSize {
+			t.Fatalf("cacher %s set from reader of negative size expect: %v but got: %v", name, ErrInvalidSize, err)
+		}
+		if err = c.SetFromReader(key, 5, bytes.NewReader([]byte("value")), 7, 0); err != nil {
+			t.Fatalf("cacher %s set from reader error: %v", name, err)
+		}
+		value, flags, err := c.GetInto(key, make([]byte, 0, 16))
+		if err != nil || string(value) != "value" || flags != 7 {
+			t.Fatalf("cacher %s get into expect: value, 7 but got: %s, %d, %v", name, value, flags, err)
+		}
+		buffer := new(bytes.Buffer)
+		if flags, err = c.GetToWriter(key, buffer); err != nil || buffer.String() != "value" || flags != 7 {
+			t.Fatalf("cacher %s get to writer expect: value, 7 but got: %s, %d, %v", name, buffer, flags, err)
+		}
+		var found []string
+		if err = c.MultiGetFunc([]string{key, key + "_missing"}, func(key string, value []byte, flags uint32) {
+			found = append(found, key)
+		}); err != nil || !reflect.DeepEqual(found, []string{key}) {
+			t.Fatalf("cacher %s multi get func expect: %s but got: %v, %v", name, key, found, err)
+		}
+		if err = c.SetObject(key, map[string]int{"count": 1}, 0); err != nil {
+			t.Fatalf("cacher %s set object error: %v", name, err)
+		}
+		var object map[string]int
+		if err = c.GetObject(key, &object); err != nil || object["count"] != 1 {
+			t.Fatalf("cacher %s get object expect count 1 but got: %v, %v", name, object, err)
+		}
+		loaded, err := c.GetOrLoad(context.Background(), key+"_load", time.Minute, func(ctx context.Context) ([]byte, error) {
+			return []byte("loaded"), nil
+		})
+		if err != nil || string(loaded) != "loaded" {
+			t.Fatalf("cacher %s get or load expect: loaded but got: %s, %v", name, loaded, err)
+		}
+		if err = c.Ping(); err != nil {
+			t.Fatalf("cacher %s ping error: %v", name, err)
+		}
+		if err = c.FlushAll(-time.Second); err != ErrInvalidExpiration {
+			t.Fatalf("cacher %s flush all with negative delay expect: %v but got: %v", name, ErrInvalidExpiration, err)
+		}
+		if err = c.FlushAll(0); err != nil {
+			t.Fatalf("cacher %s flush all error: %v", name, err)
+		}
+		if items, err = c.MultiGet([]string{key, key + "_load"}); err != nil || len(items) != 0 {
+			t.Fatalf("cacher %s multi get after flush all expect miss but got: %v, %v", name, items, err)
+		}
+	}
+	cache := NewMemoryCache()
+	now := time.Now()
+	cache.SetClock(func() time.Time { return now })
+	cache.Set(&Item{Key: "relative", Value: []byte("value"), Expiration: 10})
+	cache.Set(&Item{Key: "absolute", Value: []byte("value"), Expiration: uint32(now.Unix()) + 20})
+	cache.Set(&Item{Key: "ttl", Value: []byte("value"), TTL: 30 * time.Second})
+	cache.Set(&Item{Key: "forever", Value: []byte("value")})
+	for _, c := range []struct {
+		elapsed time.Duration
+		keys    []string
+	}{
+		{9 * time.Second, []string{"absolute", "forever", "relative", "ttl"}},
+		{10 * time.Second, []string{"absolute", "forever", "ttl"}},
+		{20 * time.Second, []string{"forever", "ttl"}},
+		{time.Hour, []string{"forever"}},
+	} {
+		cache.SetClock(func() time.Time { return now.Add(c.elapsed) })
+		items, err := cache.MultiGet([]string{"absolute", "forever", "relative", "ttl"})
+		if err != nil || len(items) != len(c.keys) {
+			t.Fatalf("memory cache after %s expect: %v but got: %v, %v", c.elapsed, c.keys, items, err)
+		}
+		for i, item := range items {
+			if item.Key != c.keys[i] {
+				t.Fatalf("memory cache after %s expect: %v but got: %v", c.elapsed, c.keys, items)
+			}
+		}
+	}
+	// items stored before the delayed flush are invalidated
+	cache.FlushAll(time.Minute)
+	if item, err := cache.Get("forever"); err != nil || item == nil {
+		t.Fatalf("memory cache before delayed flush expect item but got: %v, %v", item, err)
+	}
+	cache.SetClock(func() time.Time { return now.Add(time.Hour + 2*time.Minute) })
+	cache.Set(&Item{Key: "relative", Value: []byte("value")})
+	if items, err := cache.MultiGet([]string{"forever", "relative"}); err != nil || len(items) != 1 || items[0].Key != "relative" {
+		t.Fatalf("memory cache after delayed flush expect: relative but got: %v, %v", items, err)
+	}
+	if _, err := cache.Increment("relative", 1); err == nil {
+		t.Fatalf("memory cache increment non-numeric value expect error")
+	}
+	ns := NewNamespace(cache, "test_memory_namespace", 0)
+	if err := ns.Set(&Item{Key: "key", Value: []byte("value")}); err != nil {
+		t.Fatalf("memory cache namespace set error: %v", err)
+	}
+	if err := ns.Invalidate(); err != nil {
+		t.Fatalf("memory cache namespace invalidate error: %v", err)
+	}
+	if item, err := ns.Get("key"); err != nil || item != nil {
+		t.Fatalf("memory cache namespace get invalidated key expect nil but got: %+v, %v", item, err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	server, err := memcachetest.NewServer()
+	if err != nil {
+		t.Fatalf("start server error: %v", err)
+	}
+	defer server.Close()
+	server.SetAuth("user", "password")
+	for _, protocol := range []string{"binary", "text", "meta"} {
+		// memcached takes any set before authentication as the credentials
+		unauthenticated := error(ServerError("CLIENT_ERROR authentication failure"))
+		if protocol == "binary" {
+			unauthenticated = ErrAuthFailed
+		}
+		for _, c := range []struct {
+			username string
+			password string
+			err      error
+		}{
+			{"user", "password", nil},
+			{"user", "wrong", ErrAuthFailed},
+			{"", "", unauthenticated},
+		} {
+			client := newTestClient(t, protocol, server.Addr())
+			if c.username != "" {
+				client.SetAuth(c.username, c.password)
+			}
+			key := fmt.Sprintf("test_%s_auth_key", protocol)
+			if err = client.Set(&Item{Key: key, Value: []byte("value")}); err != c.err {
+				t.Fatalf("client %s set with %s/%s expect: %v but got: %v", protocol, c.username, c.password, c.err, err)
+			}
+			if c.err != nil {
+				continue
+			}
+			if item, err := client.Get(key); err != nil || item == nil || string(item.Value) != "value" {
+				t.Fatalf("client %s get after auth expect value but got: %+v, %v", protocol, item, err)
+			}
+		}
+	}
+}
+
+func TestPoolDialUnlocked(t *testing.T) {
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	pool := &Pool{MaxIdleConns: 1, MaxActiveConns: 2, IdleTimeout: time.Minute, SocketTimeout: time.Second}
+	pool.DialFunc = func() (Conn, error) {
+		close(dialing)
+		<-release
+		return nil, fmt.Errorf("dial error")
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.Get()
+		done <- err
+	}()
+	<-dialing
+	// a slow dial or authentication doesn't block other callers of the pool
+	stats := make(chan PoolStats, 1)
+	go func() {
+		stats <- pool.Stats()
+	}()
+	select {
+	case s := <-stats:
+		if s.ActiveConns != 1 {
+			t.Fatalf("pool while dialing expect 1 active conn but got: %+v", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("pool is locked while dialing")
+	}
+	close(release)
+	if err := <-done; err == nil {
+		t.Fatalf("pool get expect dial error")
+	}
+	if s := pool.Stats(); s.ActiveConns != 0 {
+		t.Fatalf("pool after dial error expect no active conns but got: %+v", s)
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	for _, protocol := range testProtocols {
+		var servers []*memcachetest.Server
+		var addrs []string
+		for i := 0; i < 3; i++ {
+			server, err := memcachetest.NewServer()
+			if err != nil {
+				t.Fatalf("start server error: %v", err)
+			}
+			defer server.Close()
+			servers = append(servers, server)
+			addrs = append(addrs, server.Addr())
+		}
+		c := newTestClient(t, protocol, addrs...)
+		c.SetReplicas(2)
+		// copies return the value of key on every server, missing values are empty
+		copies := func(key string) []string {
+			var values []string
+			for _, addr := range addrs {
+				single, _ := NewClient([]string{addr})
+				item, err := single.Get(key)
+				if err != nil {
+					t.Fatalf("client %s get %s from %s error: %v", protocol, key, addr, err)
+				}
+				value := ""
+				if item != nil {
+					value = string(item.Value)
+				}
+				values = append(values, value)
+			}
+			return values
+		}
+		key := fmt.Sprintf("test_%s_replica_key", protocol)
+		primary := c.protocol.serverIndex(key)
+		replica := (primary + 1) % len(addrs)
+		// expect return the values expected on the primary and the replica
+		expect := func(primaryValue, replicaValue string) []string {
+			values := make([]string, len(addrs))
+			values[primary], values[replica] = primaryValue, replicaValue
+			return values
+		}
+		single := newTestClient(t, protocol, addrs[primary])
+		if err := c.Set(&Item{Key: key, Value: []byte("value")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		if held := copies(key); !reflect.DeepEqual(held, expect("value", "value")) {
+			t.Fatalf("client %s set expect copies: %v but got: %v", protocol, expect("value", "value"), held)
+		}
+		// binary protocol replies exists to add of existing keys
+		if err := c.Add(&Item{Key: key, Value: []byte("value")}); err != ErrItemNotStored && err != ErrItemExists {
+			t.Fatalf("client %s add existing key expect: %v but got: %v", protocol, ErrItemNotStored, err)
+		}
+		// copies rejecting the command decided by the primary are deleted
+		if err := single.Delete(key); err != nil {
+			t.Fatalf("client %s delete from primary error: %v", protocol, err)
+		}
+		if err := c.Add(&Item{Key: key, Value: []byte("added")}); err != nil {
+			t.Fatalf("client %s add error: %v", protocol, err)
+		}
+		if held := copies(key); !reflect.DeepEqual(held, expect("added", "")) {
+			t.Fatalf("client %s add expect copies: %v but got: %v", protocol, expect("added", ""), held)
+		}
+		if err := c.Replace(&Item{Key: key, Value: []byte("replaced")}); err != nil {
+			t.Fatalf("client %s replace error: %v", protocol, err)
+		}
+		if err := c.Set(&Item{Key: key, Value: []byte("value")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		if err := c.Replace(&Item{Key: key, Value: []byte("replaced")}); err != nil {
+			t.Fatalf("client %s replace error: %v", protocol, err)
+		}
+		if held := copies(key); !reflect.DeepEqual(held, expect("replaced", "replaced")) {
+			t.Fatalf("client %s replace expect copies: %v but got: %v", protocol, expect("replaced", "replaced"), held)
+		}
+		// CAS unique of the primary is checked by the primary only
+		item, err := c.Gets(key)
+		if err != nil || item == nil {
+			t.Fatalf("client %s gets expect item but got: %+v, %v", protocol, item, err)
+		}
+		outdated := *item
+		item.Value = []byte("cas_value")
+		if err = c.CAS(item); err != nil {
+			t.Fatalf("client %s cas error: %v", protocol, err)
+		}
+		if held := copies(key); !reflect.DeepEqual(held, expect("cas_value", "cas_value")) {
+			t.Fatalf("client %s cas expect copies: %v but got: %v", protocol, expect("cas_value", "cas_value"), held)
+		}
+		// a set of the outdated item is rejected by the first server only
+		// with binary protocol, no copy is changed then
+		outdated.Value = []byte("outdated")
+		err = c.Set(&outdated)
+		want := expect("outdated", "outdated")
+		if protocol == "binary" {
+			if err != ErrItemExists {
+				t.Fatalf("client %s set outdated item expect: %v but got: %v", protocol, ErrItemExists, err)
+			}
+			want = expect("cas_value", "cas_value")
+		} else if err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		if held := copies(key); !reflect.DeepEqual(held, want) {
+			t.Fatalf("client %s set outdated item expect copies: %v but got: %v", protocol, want, held)
+		}
+		counter := key + "_counter"
+		if err = c.Set(&Item{Key: counter, Value: []byte("1")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		if value, err := c.Increment(counter, 2); err != nil || value != 3 {
+			t.Fatalf("client %s increment expect: 3 but got: %d, %v", protocol, value, err)
+		}
+		counterPrimary := c.protocol.serverIndex(counter)
+		counterCopies := make([]string, len(addrs))
+		counterCopies[counterPrimary], counterCopies[(counterPrimary+1)%len(addrs)] = "3", "3"
+		if held := copies(counter); !reflect.DeepEqual(held, counterCopies) {
+			t.Fatalf("client %s increment expect copies: %v but got: %v", protocol, counterCopies, held)
+		}
+		// a miss on the first server is read from the next copy
+		if err = c.Set(&Item{Key: key, Value: []byte("value")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		if err = single.Delete(key); err != nil {
+			t.Fatalf("client %s delete from primary error: %v", protocol, err)
+		}
+		if item, err = c.Get(key); err != nil || item == nil || string(item.Value) != "value" {
+			t.Fatalf("client %s get expect replica value but got: %+v, %v", protocol, item, err)
+		}
+		items, err := c.MultiGet([]string{key, key + "_missing"})
+		if err != nil || len(items) != 1 || string(items[0].Value) != "value" {
+			t.Fatalf("client %s multi get expect replica value but got: %v, %v", protocol, items, err)
+		}
+		if value, _, err := c.GetInto(key, nil); err != nil || string(value) != "value" {
+			t.Fatalf("client %s get into expect replica value but got: %s, %v", protocol, value, err)
+		}
+		var found []string
+		if err = c.MultiGetFunc([]string{key, key + "_missing"}, func(key string, value []byte, flags uint32) {
+			found = append(found, string(value))
+		}); err != nil || !reflect.DeepEqual(found, []string{"value"}) {
+			t.Fatalf("client %s multi get func expect replica value but got: %v, %v", protocol, found, err)
+		}
+		buffer := new(bytes.Buffer)
+		if _, err = c.GetToWriter(key, buffer); err != nil || buffer.String() != "value" {
+			t.Fatalf("client %s get to writer expect replica value but got: %s, %v", protocol, buffer, err)
+		}
+		if err = c.Delete(key); err != nil {
+			t.Fatalf("client %s delete error: %v", protocol, err)
+		}
+		if held := copies(key); !reflect.DeepEqual(held, make([]string, len(addrs))) {
+			t.Fatalf("client %s delete expect no copy but got: %v", protocol, held)
+		}
+		if err = c.Delete(key); err != ErrItemNotFound {
+			t.Fatalf("client %s delete missing key expect: %v but got: %v", protocol, ErrItemNotFound, err)
+		}
+		// the old value isn't kept by a primary failing to store the new one
+		if err = c.Set(&Item{Key: key, Value: []byte("old")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		servers[primary].ItemSizeMax = 8
+		err = c.Set(&Item{Key: key, Value: []byte("larger new value")})
+		servers[primary].ItemSizeMax = 1024 * 1024
+		if err != nil {
+			t.Fatalf("client %s set rejected by primary error: %v", protocol, err)
+		}
+		if held := copies(key); !reflect.DeepEqual(held, expect("", "larger new value")) {
+			t.Fatalf("client %s set rejected by primary expect copies: %v but got: %v", protocol, expect("", "larger new value"), held)
+		}
+		if item, err = c.Get(key); err != nil || item == nil || string(item.Value) != "larger new value" {
+			t.Fatalf("client %s get after set rejected by primary expect new value but got: %+v, %v", protocol, item, err)
+		}
+		// the loss of the first server is survived by reads, writes fail
+		// since the first server may keep the old value
+		if err = c.Set(&Item{Key: key, Value: []byte("value")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		servers[primary].Close()
+		if item, err = c.Get(key); err != nil || item == nil || string(item.Value) != "value" {
+			t.Fatalf("client %s get after losing primary expect value but got: %+v, %v", protocol, item, err)
+		}
+		if err = c.Set(&Item{Key: key, Value: []byte("new_value")}); err == nil {
+			t.Fatalf("client %s set after losing primary expect error", protocol)
+		}
+		if item, err = c.Get(key); err != nil || item == nil || string(item.Value) != "new_value" {
+			t.Fatalf("client %s get after losing primary expect new_value but got: %+v, %v", protocol, item, err)
+		}
+	}
+}
+
+func TestHedging(t *testing.T) {
+	for _, protocol := range testProtocols {
+		var addrs []string
+		var proxies []*memcachetest.Proxy
+		for i := 0; i < 2; i++ {
+			server, err := memcachetest.NewServer()
+			if err != nil {
+				t.Fatalf("start server error: %v", err)
+			}
+			defer server.Close()
+			proxy, err := memcachetest.NewProxy(server.Addr())
+			if err != nil {
+				t.Fatalf("start proxy error: %v", err)
+			}
+			defer proxy.Close()
+			proxies = append(proxies, proxy)
+			addrs = append(addrs, proxy.Addr())
+		}
+		c := newTestClient(t, protocol, addrs...)
+		c.SetReplicas(2)
+		key := fmt.Sprintf("test_%s_hedging_key", protocol)
+		if err := c.Set(&Item{Key: key, Value: []byte("value")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		primary := c.protocol.serverIndex(key)
+		slow := proxies[primary]
+		for _, delay := range []time.Duration{20 * time.Millisecond, HedgeP95} {
+			c.SetHedging(delay)
+			if delay == HedgeP95 {
+				// the percentile is estimated after 100 reads
+				for i := 0; i < 100; i++ {
+					if _, err := c.Get(key); err != nil {
+						t.Fatalf("client %s get error: %v", protocol, err)
+					}
+				}
+			}
+			slow.SetFaults(memcachetest.Faults{Latency: time.Second})
+			start := time.Now()
+			item, err := c.Get(key)
+			if err != nil || item == nil || string(item.Value) != "value" {
+				t.Fatalf("client %s hedged get expect value but got: %+v, %v", protocol, item, err)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Fatalf("client %s hedged get with delay %s took: %s", protocol, delay, elapsed)
+			}
+			// the slower read is canceled rather than left waiting the reply
+			for deadline := time.Now().Add(200 * time.Millisecond); c.protocol.poolStats(primary).ActiveConns != 0; {
+				if time.Now().After(deadline) {
+					t.Fatalf("client %s hedged get expect the slower read canceled", protocol)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			items, err := c.MultiGet([]string{key, key + "_missing"})
+			if err != nil || len(items) != 1 {
+				t.Fatalf("client %s hedged multi get expect one item but got: %v, %v", protocol, items, err)
+			}
+			slow.SetFaults(memcachetest.Faults{})
+		}
+		// a miss of the faster copy waits the slower one
+		c.SetHedging(20 * time.Millisecond)
+		single := newTestClient(t, protocol, addrs[(primary+1)%len(addrs)])
+		if err := single.Delete(key); err != nil {
+			t.Fatalf("client %s delete from replica error: %v", protocol, err)
+		}
+		slow.SetFaults(memcachetest.Faults{Latency: 100 * time.Millisecond})
+		item, err := c.Get(key)
+		if err != nil || item == nil || string(item.Value) != "value" {
+			t.Fatalf("client %s hedged get expect value of the slower copy but got: %+v, %v", protocol, item, err)
+		}
+		// reads of the slow server lost to hedged reads keep the estimate
+		if err = c.Set(&Item{Key: key, Value: []byte("value")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		latency := 4 * time.Millisecond
+		slow.SetFaults(memcachetest.Faults{Latency: latency})
+		c.SetHedging(HedgeP95)
+		gets := func(goroutines, n int) {
+			var wg sync.WaitGroup
+			for i := 0; i < goroutines; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < n; j++ {
+						if _, err := c.Get(key); err != nil {
+							t.Errorf("client %s get error: %v", protocol, err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		}
+		gets(10, 10)
+		// every read is hedged and won by the replica once the server slows down
+		slow.SetFaults(memcachetest.Faults{Latency: 3 * latency})
+		gets(16, 125)
+		if estimate := c.latencies.p95(); estimate < latency {
+			t.Fatalf("client %s hedging estimate expect %s at least but got: %s", protocol, latency, estimate)
+		}
+		slow.SetFaults(memcachetest.Faults{})
+	}
+}
+
+func TestForeignFlags(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		key := fmt.Sprintf("test_%s_foreign_flags_key", protocol)
+		other := fmt.Sprintf("test_%s_foreign_flags_other", protocol)
+		flags := uint32(1<<31 | 1<<30)
+		// high bits are left to callers when client features are disabled,
+		// except the envelope bit
+		if err := c.Set(&Item{Key: key, Value: []byte("value"), Flags: flags}); err != nil {
+			t.Fatalf("client %s set high flags error: %v", protocol, err)
+		}
+		if err := c.Set(&Item{Key: key, Value: []byte("value"), Flags: flagEnvelope}); err != ErrReservedFlags {
+			t.Fatalf("client %s set envelope flag expect: %v but got: %v", protocol, ErrReservedFlags, err)
+		}
+		if err := c.Set(&Item{Key: other, Value: []byte("other")}); err != nil {
+			t.Fatalf("client %s set error: %v", protocol, err)
+		}
+		items, err := c.MultiGet([]string{key, other})
+		if err != nil || len(items) != 2 {
+			t.Fatalf("client %s multi get expect 2 items but got: %v, %v", protocol, items, err)
+		}
+		for _, item := range items {
+			if item.Key == key && (item.Flags != flags || string(item.Value) != "value") {
+				t.Fatalf("client %s multi get expect flags kept but got: %+v", protocol, item)
+			}
+		}
+		// values which can't be decoded are misses of their keys only
+		c.SetChunkSize(1000)
+		c.SetCompression(100)
+		c.SetEarlyExpiration(1)
+		if items, err = c.MultiGet([]string{key, other}); err != nil || len(items) != 1 || items[0].Key != other {
+			t.Fatalf("client %s multi get expect only %s but got: %v, %v", protocol, other, items, err)
+		}
+		if item, err := c.Get(key); err != nil || item != nil {
+			t.Fatalf("client %s get undecodable value expect miss but got: %+v, %v", protocol, item, err)
+		}
+	})
+}
+
+func TestGetOrLoadFailures(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol string, c *Client) {
+		key := fmt.Sprintf("test_%s_load_failures_key", protocol)
+		value := []byte("value")
+		loader := func(ctx context.Context) ([]byte, error) {
+			return value, nil
+		}
+		c.Delete(key)
+		// a panic of the loader is raised to its caller and others load again
+		waiter := make(chan error, 1)
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatalf("client %s GetOrLoad expect the loader panic raised", protocol)
+				}
+			}()
+			c.GetOrLoad(context.Background(), key, time.Minute, func(ctx context.Context) ([]byte, error) {
+				go func() {
+					_, err := c.GetOrLoad(context.Background(), key, time.Minute, loader)
+					waiter <- err
+				}()
+				time.Sleep(50 * time.Millisecond)
+				panic("loader failure")
+			})
+		}()
+		if err := <-waiter; err == nil {
+			t.Fatalf("client %s GetOrLoad waiting a panicking loader expect error", protocol)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		result, err := c.GetOrLoad(ctx, key, time.Minute, loader)
+		cancel()
+		if err != nil || !bytes.Equal(value, result) {
+			t.Fatalf("client %s GetOrLoad after panic expect: %s but got: %s, %v", protocol, value, result, err)
+		}
+		// waiters don't get the ctx error of the loading caller
+		c.Delete(key)
+		ctx, cancel = context.WithCancel(context.Background())
+		_, err = c.GetOrLoad(ctx, key, time.Minute, func(ctx context.Context) ([]byte, error) {
+			go func() {
+				_, err := c.GetOrLoad(context.Background(), key, time.Minute, loader)
+				waiter <- err
+			}()
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		if err != context.Canceled {
+			t.Fatalf("client %s GetOrLoad expect: %v but got: %v", protocol, context.Canceled, err)
+		}
+		if err = <-waiter; err != nil {
+			t.Fatalf("client %s GetOrLoad waiting a canceled loader error: %v", protocol, err)
+		}
+	})
+}
+
+func TestMetaMalformedValue(t *testing.T) {
+	proxy, err := memcachetest.NewProxy(testServers[0])
+	if err != nil {
+		t.Fatalf("start proxy error: %v", err)
+	}
+	defer proxy.Close()
+	c := newTestClient(t, "meta", proxy.Addr())
+	for _, reply := range []string{"VA \r\n", "VA -1 f0\r\n"} {
+		proxy.SetFaults(memcachetest.Faults{Error: reply})
+		if lease, err := c.GetLease("test_meta_malformed_key"); err != ErrInvalidResponseFormat {
+			t.Fatalf("client meta get lease with reply %q expect: %v but got: %+v, %v", reply, ErrInvalidResponseFormat, lease, err)
+		}
+	}
+}
+
+func TestNearCacheGenerations(t *testing.T) {
+	cache := newNearCache(1024, time.Minute)
+	key, other := "key", "other"
+	for i := 0; nearShard(other) == nearShard(key); i++ {
+		other = fmt.Sprintf("other_%d", i)
+	}
+	// writes of keys in other shards don't discard fills
+	generations := cache.begin()
+	cache.invalidate(other)
+	cache.add(generations, []*Item{{Key: key, Value: []byte("value")}})
+	if item := cache.get(key); item == nil {
+		t.Fatalf("near cache expect %s filled after invalidating %s", key, other)
+	}
+	generations = cache.begin()
+	cache.invalidate(key)
+	cache.add(generations, []*Item{{Key: key, Value: []byte("value")}})
+	if item := cache.get(key); item != nil {
+		t.Fatalf("near cache expect fill of %s discarded after its invalidation but got: %+v", key, item)
+	}
+}
+
 func BenchmarkBinarySet(b *testing.B) {
 	item := &Item{Key: "bench_binary_set", Value: []byte("world")}
 	b.ReportAllocs()
@@ -0,0 +1,337 @@
+package memcachetest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+const (
+	requestMagic  = 0x80
+	responseMagic = 0x81
+	headerSize    = 24
+)
+
+const (
+	opGet        = 0x00
+	opSet        = 0x01
+	opAdd        = 0x02
+	opReplace    = 0x03
+	opDelete     = 0x04
+	opIncrement  = 0x05
+	opDecrement  = 0x06
+	opQuit       = 0x07
+	opFlush      = 0x08
+	opGetQ       = 0x09
+	opNoop       = 0x0a
+	opVersion    = 0x0b
+	opGetK       = 0x0c
+	opGetKQ      = 0x0d
+	opAppend     = 0x0e
+	opPrepend    = 0x0f
+	opStat       = 0x10
+	opSetQ       = 0x11
+	opAddQ       = 0x12
+	opReplaceQ   = 0x13
+	opDeleteQ    = 0x14
+	opIncrementQ = 0x15
+	opDecrementQ = 0x16
+	opQuitQ      = 0x17
+	opFlushQ     = 0x18
+	opAppendQ    = 0x19
+	opPrependQ   = 0x1a
+	opTouch      = 0x1c
+	opGAT        = 0x1d
+	opGATQ       = 0x1e
+	opSASLList   = 0x20
+	opSASLAuth   = 0x21
+	opSASLStep   = 0x22
+)
+
+const (
+	statusOK              = 0x00
+	statusKeyNotFound     = 0x01
+	statusKeyExists       = 0x02
+	statusValueTooLarge   = 0x03
+	statusInvalidArgs     = 0x04
+	statusItemNotStored   = 0x05
+	statusNonNumericValue = 0x06
+	statusAuthError       = 0x20
+	statusUnknownCommand  = 0x81
+)
+
+var statusMessages = map[uint16]string{
+	statusKeyNotFound:     "Not found",
+	statusKeyExists:       "Data exists for key.",
+	statusValueTooLarge:   "Too large.",
+	statusInvalidArgs:     "Invalid arguments",
+	statusItemNotStored:   "Not stored.",
+	statusNonNumericValue: "Non-numeric server-side value for incr or decr",
+	statusAuthError:       "Auth failure.",
+	statusUnknownCommand:  "Unknown command",
+}
+
+var binaryStatus = map[status]uint16{
+	statusStored:     statusOK,
+	statusNotStored:  statusItemNotStored,
+	statusExists:     statusKeyExists,
+	statusNotFound:   statusKeyNotFound,
+	statusTooLarge:   statusValueTooLarge,
+	statusNonNumeric: statusNonNumericValue,
+}
+
+// request binary request packet
+type request struct {
+	opcode uint8
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    string
+	value  []byte
+}
+
+// response binary response packet
+type response struct {
+	status uint16
+	cas    uint64
+	extras []byte
+	key    string
+	value  []byte
+}
+
+func readRequest(reader io.Reader) (*request, error) {
+	hdr := make([]byte, headerSize)
+	if _, err := io.ReadFull(reader, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != requestMagic {
+		return nil, io.ErrUnexpectedEOF
+	}
+	keyLength := int(binary.BigEndian.Uint16(hdr[2:4]))
+	extrasLength := int(hdr[4])
+	bodyLength := int(binary.BigEndian.Uint32(hdr[8:12]))
+	if keyLength+extrasLength > bodyLength {
+		return nil, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, bodyLength)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	return &request{
+		opcode: hdr[1],
+		opaque: binary.BigEndian.Uint32(hdr[12:16]),
+		cas:    binary.BigEndian.Uint64(hdr[16:24]),
+		extras: body[:extrasLength],
+		key:    string(body[extrasLength : extrasLength+keyLength]),
+		value:  body[extrasLength+keyLength:],
+	}, nil
+}
+
+func writeResponse(w *bufio.Writer, req *request, resp *response) {
+	hdr := make([]byte, headerSize)
+	hdr[0] = responseMagic
+	hdr[1] = req.opcode
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(resp.key)))
+	hdr[4] = uint8(len(resp.extras))
+	binary.BigEndian.PutUint16(hdr[6:8], resp.status)
+	binary.BigEndian.PutUint32(hdr[8:12], uint32(len(resp.extras)+len(resp.key)+len(resp.value)))
+	binary.BigEndian.PutUint32(hdr[12:16], req.opaque)
+	binary.BigEndian.PutUint64(hdr[16:24], resp.cas)
+	w.Write(hdr)
+	w.Write(resp.extras)
+	w.WriteString(resp.key)
+	w.Write(resp.value)
+}
+
+func errorResponse(code uint16) *response {
+	return &response{status: code, value: []byte(statusMessages[code])}
+}
+
+func (s *Server) serveBinary(reader *bufio.Reader, writer *bufio.Writer) {
+	authenticated := !s.authRequired()
+	for {
+		req, err := readRequest(reader)
+		if err != nil {
+			return
+		}
+		var resp *response
+		var quit bool
+		switch {
+		case req.opcode == opSASLList || req.opcode == opSASLAuth || req.opcode == opSASLStep:
+			resp = s.handleSASL(req)
+			authenticated = authenticated || resp.status == statusOK
+		case !authenticated && req.opcode != opVersion:
+			// memcached only answers version before authentication
+			resp = errorResponse(statusAuthError)
+		default:
+			resp, quit = s.handleBinary(req, writer)
+		}
+		if resp != nil {
+			writeResponse(writer, req, resp)
+		}
+		if quit {
+			writer.Flush()
+			return
+		}
+		if reader.Buffered() == 0 {
+			if err = writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleBinary handle one request, a nil response means nothing to reply
+func (s *Server) handleBinary(req *request, w *bufio.Writer) (*response, bool) {
+	switch req.opcode {
+	case opGet, opGetQ, opGetK, opGetKQ, opGAT, opGATQ:
+		var it item
+		var ok bool
+		if req.opcode == opGAT || req.opcode == opGATQ {
+			if len(req.extras) != 4 {
+				return errorResponse(statusInvalidArgs), false
+			}
+			var st status
+			it, st = s.touch(req.key, int64(int32(binary.BigEndian.Uint32(req.extras))))
+			ok = st == statusStored
+		} else {
+			it, ok = s.lookup(req.key)
+		}
+		withKey := req.opcode == opGetK || req.opcode == opGetKQ
+		quiet := req.opcode == opGetQ || req.opcode == opGetKQ || req.opcode == opGATQ
+		if !ok {
+			if quiet {
+				return nil, false
+			}
+			if withKey {
+				return &response{status: statusKeyNotFound, key: req.key}, false
+			}
+			return errorResponse(statusKeyNotFound), false
+		}
+		resp := &response{cas: it.cas, extras: make([]byte, 4), value: it.value}
+		binary.BigEndian.PutUint32(resp.extras, it.flags)
+		if withKey {
+			resp.key = req.key
+		}
+		return resp, false
+	case opSet, opAdd, opReplace, opSetQ, opAddQ, opReplaceQ:
+		if len(req.extras) != 8 {
+			return errorResponse(statusInvalidArgs), false
+		}
+		mode := map[uint8]string{
+			opSet: "set", opSetQ: "set", opAdd: "add", opAddQ: "add", opReplace: "replace", opReplaceQ: "replace",
+		}[req.opcode]
+		flags := binary.BigEndian.Uint32(req.extras[:4])
+		exptime := int64(int32(binary.BigEndian.Uint32(req.extras[4:])))
+		st := s.store(mode, req.key, flags, exptime, append([]byte{}, req.value...), req.cas)
+		if mode == "replace" && st == statusNotStored {
+			st = statusNotFound
+		}
+		if mode == "add" && st == statusNotStored {
+			st = statusExists
+		}
+		return s.storeResponse(req, st, req.opcode >= opSetQ), false
+	case opAppend, opPrepend, opAppendQ, opPrependQ:
+		mode := "append"
+		if req.opcode == opPrepend || req.opcode == opPrependQ {
+			mode = "prepend"
+		}
+		st := s.store(mode, req.key, 0, 0, append([]byte{}, req.value...), req.cas)
+		return s.storeResponse(req, st, req.opcode >= opAppendQ), false
+	case opDelete, opDeleteQ:
+		st := s.delete(req.key)
+		if st == statusStored && req.opcode == opDeleteQ {
+			return nil, false
+		}
+		if st != statusStored {
+			return errorResponse(binaryStatus[st]), false
+		}
+		return &response{}, false
+	case opIncrement, opDecrement, opIncrementQ, opDecrementQ:
+		if len(req.extras) != 20 {
+			return errorResponse(statusInvalidArgs), false
+		}
+		delta := binary.BigEndian.Uint64(req.extras[:8])
+		initial := binary.BigEndian.Uint64(req.extras[8:16])
+		exptime := binary.BigEndian.Uint32(req.extras[16:])
+		decr := req.opcode == opDecrement || req.opcode == opDecrementQ
+		n, st := s.incr(req.key, delta, decr, exptime != 0xffffffff, initial, int64(int32(exptime)))
+		if st != statusStored {
+			return errorResponse(binaryStatus[st]), false
+		}
+		if req.opcode >= opIncrementQ {
+			return nil, false
+		}
+		resp := &response{value: make([]byte, 8)}
+		binary.BigEndian.PutUint64(resp.value, n)
+		return resp, false
+	case opTouch:
+		if len(req.extras) != 4 {
+			return errorResponse(statusInvalidArgs), false
+		}
+		if _, st := s.touch(req.key, int64(int32(binary.BigEndian.Uint32(req.extras)))); st != statusStored {
+			return errorResponse(statusKeyNotFound), false
+		}
+		return &response{}, false
+	case opFlush, opFlushQ:
+		var delay int64
+		if len(req.extras) == 4 {
+			delay = int64(binary.BigEndian.Uint32(req.extras))
+		}
+		s.flush(delay)
+		if req.opcode == opFlushQ {
+			return nil, false
+		}
+		return &response{}, false
+	case opNoop:
+		return &response{}, false
+	case opVersion:
+		return &response{value: []byte(Version)}, false
+	case opStat:
+		stats := s.statistics(req.key)
+		if stats == nil {
+			return errorResponse(statusKeyNotFound), false
+		}
+		for _, stat := range stats {
+			writeResponse(w, req, &response{key: stat[0], value: []byte(stat[1])})
+		}
+		return &response{}, false
+	case opQuit:
+		return &response{}, true
+	case opQuitQ:
+		return nil, true
+	}
+	return errorResponse(statusUnknownCommand), false
+}
+
+// handleSASL handle SASL requests, only PLAIN mechanism is supported
+func (s *Server) handleSASL(req *request) *response {
+	switch req.opcode {
+	case opSASLList:
+		return &response{value: []byte("PLAIN")}
+	case opSASLAuth:
+		// the PLAIN message is "authzid\x00authcid\x00passwd"
+		fields := strings.Split(string(req.value), "\x00")
+		if req.key == "PLAIN" && len(fields) == 3 && s.checkAuth(fields[1], fields[2]) {
+			return &response{value: []byte("Authenticated")}
+		}
+	}
+	return errorResponse(statusAuthError)
+}
+
+func (s *Server) storeResponse(req *request, st status, quiet bool) *response {
+	if st != statusStored {
+		return errorResponse(binaryStatus[st])
+	}
+	if quiet {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cas uint64
+	if it := s.get(req.key); it != nil {
+		cas = it.cas
+	}
+	return &response{cas: cas}
+}
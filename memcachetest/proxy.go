@@ -0,0 +1,205 @@
+package memcachetest
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Faults injected by Proxy, the zero value forwards traffic as is
+type Faults struct {
+	// Latency delays every response read from server
+	Latency time.Duration
+	// ResetAfter resets client connections once they received so many
+	// response bytes, zero disables it
+	ResetAfter int
+	// Corrupt flips the bits of the first byte of every response read from server
+	Corrupt bool
+	// Blackhole drops requests without any response so that clients time out
+	Blackhole bool
+	// Error replies the line, such as "SERVER_ERROR out of memory\r\n", to
+	// every read of requests instead of forwarding them, it suits text protocol
+	Error string
+}
+
+// Proxy TCP proxy in front of a memcached address injecting faults
+type Proxy struct {
+	target string
+	ln     net.Listener
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	faults Faults
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// NewProxy start a proxy of target on a random local port
+func NewProxy(target string) (*Proxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{target: target, ln: ln, conns: make(map[net.Conn]struct{})}
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+// Addr the address proxy listening on
+func (p *Proxy) Addr() string {
+	return p.ln.Addr().String()
+}
+
+// SetFaults replace the faults, they apply to open connections too
+func (p *Proxy) SetFaults(faults Faults) {
+	p.mu.Lock()
+	p.faults = faults
+	p.mu.Unlock()
+}
+
+func (p *Proxy) currentFaults() Faults {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.faults
+}
+
+// Close stop listening and close all connections
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	err := p.ln.Close()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
+
+// track register conn to be closed by Close, false if proxy is closed
+func (p *Proxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	delete(p.conns, conn)
+	p.mu.Unlock()
+	conn.Close()
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		if !p.track(conn) {
+			conn.Close()
+			return
+		}
+		p.wg.Add(1)
+		go p.serveConn(conn)
+	}
+}
+
+func (p *Proxy) serveConn(client net.Conn) {
+	defer p.wg.Done()
+	defer p.untrack(client)
+	server, err := net.Dial("tcp", p.target)
+	if err != nil {
+		return
+	}
+	if !p.track(server) {
+		server.Close()
+		return
+	}
+	defer p.untrack(server)
+	done := make(chan struct{})
+	go func() {
+		p.forwardResponses(server, client)
+		// unblock reading requests
+		client.Close()
+		close(done)
+	}()
+	p.forwardRequests(client, server)
+	server.Close()
+	<-done
+}
+
+// forwardRequests copy requests from client to server applying faults
+func (p *Proxy) forwardRequests(client, server net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := client.Read(buf)
+		if n > 0 {
+			faults := p.currentFaults()
+			switch {
+			case faults.Blackhole:
+			case faults.Error != "":
+				if _, e := io.WriteString(client, faults.Error); e != nil {
+					return
+				}
+			default:
+				if _, e := server.Write(buf[:n]); e != nil {
+					return
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// forwardResponses copy responses from server to client applying faults
+func (p *Proxy) forwardResponses(server, client net.Conn) {
+	buf := make([]byte, 32*1024)
+	sent := 0
+	for {
+		n, err := server.Read(buf)
+		if n > 0 {
+			faults := p.currentFaults()
+			if faults.Latency > 0 {
+				time.Sleep(faults.Latency)
+			}
+			data := buf[:n]
+			if faults.Corrupt {
+				data[0] ^= 0xff
+			}
+			if faults.ResetAfter > 0 && sent+len(data) >= faults.ResetAfter {
+				if faults.ResetAfter > sent {
+					client.Write(data[:faults.ResetAfter-sent])
+				}
+				if tcp, ok := client.(*net.TCPConn); ok {
+					// send RST instead of FIN
+					tcp.SetLinger(0)
+				}
+				return
+			}
+			if faults.Blackhole {
+				continue
+			}
+			if _, e := client.Write(data); e != nil {
+				return
+			}
+			sent += len(data)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,424 @@
+// Package memcachetest provides an in-memory memcached server for tests.
+//
+// The server speaks the text, meta and binary protocols on a local TCP
+// port, so clients can be exercised without a real memcached instance.
+package memcachetest
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Version is reported by the version command
+	Version = "1.6.21-memcachetest"
+
+	defaultItemSizeMax = 1024 * 1024
+	maxRelativeExpire  = 60 * 60 * 24 * 30
+)
+
+type status int
+
+const (
+	statusStored status = iota
+	statusNotStored
+	statusExists
+	statusNotFound
+	statusTooLarge
+	statusNonNumeric
+)
+
+// item stored in the server
+type item struct {
+	value   []byte
+	flags   uint32
+	exptime time.Time
+	cas     uint64
+	// stale is set by meta delete with invalidation
+	stale bool
+	// vivified marks the placeholder created by meta get on miss
+	vivified bool
+	// won is set once a client received the lease for a stale or vivified item
+	won bool
+}
+
+// Server in-memory memcached server listening on a local port
+type Server struct {
+	// ItemSizeMax is the max value size accepted, 1MB by default
+	ItemSizeMax int
+
+	ln      net.Listener
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	now     func() time.Time
+	started time.Time
+	items   map[string]*item
+	cas     uint64
+	conns   map[net.Conn]struct{}
+	closed  bool
+	stats   map[string]uint64
+	// users credentials required by SetAuth, nil means no authentication
+	users map[string]string
+}
+
+// NewServer start a server on a random local port
+func NewServer() (*Server, error) {
+	return Listen("127.0.0.1:0")
+}
+
+// Listen start a server listening on addr
+func Listen(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ItemSizeMax: defaultItemSizeMax,
+		ln:          ln,
+		now:         time.Now,
+		started:     time.Now(),
+		items:       make(map[string]*item),
+		conns:       make(map[net.Conn]struct{}),
+		stats:       make(map[string]uint64),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr the address server listening on
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// SetClock replace the clock used for expiration, default is time.Now
+func (s *Server) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	s.now = now
+	s.mu.Unlock()
+}
+
+// SetAuth require new connections to authenticate with username and
+// password, binary connections by SASL PLAIN and text connections by a
+// set of "username password" like memcached -Y does. It can be called
+// many times to add users.
+func (s *Server) SetAuth(username, password string) {
+	s.mu.Lock()
+	if s.users == nil {
+		s.users = make(map[string]string)
+	}
+	s.users[username] = password
+	s.mu.Unlock()
+}
+
+// authRequired report whether connections must authenticate
+func (s *Server) authRequired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.users != nil
+}
+
+// checkAuth report whether username and password are valid
+func (s *Server) checkAuth(username, password string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expected, ok := s.users[username]
+	return ok && expected == password
+}
+
+// Flush remove all items
+func (s *Server) Flush() {
+	s.mu.Lock()
+	s.items = make(map[string]*item)
+	s.mu.Unlock()
+}
+
+// Close stop listening and close all client connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.ln.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.stats["total_connections"]++
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	// the first byte decides the protocol of this connection like memcached does
+	b, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if b[0] == requestMagic {
+		s.serveBinary(reader, writer)
+	} else {
+		s.serveText(reader, writer)
+	}
+}
+
+// expiry convert memcached exptime to absolute time, zero time means never expire
+func (s *Server) expiry(exptime int64) time.Time {
+	if exptime == 0 {
+		return time.Time{}
+	}
+	if exptime < 0 {
+		return s.now().Add(-time.Second)
+	}
+	if exptime <= maxRelativeExpire {
+		return s.now().Add(time.Duration(exptime) * time.Second)
+	}
+	return time.Unix(exptime, 0)
+}
+
+func (s *Server) nextCAS() uint64 {
+	s.cas++
+	return s.cas
+}
+
+// get return the live item, it must be called with lock held
+func (s *Server) get(key string) *item {
+	it, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	if !it.exptime.IsZero() && !s.now().Before(it.exptime) {
+		delete(s.items, key)
+		return nil
+	}
+	return it
+}
+
+// lookup return a copy of the item counting hits and misses
+func (s *Server) lookup(key string) (item, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats["cmd_get"]++
+	it := s.get(key)
+	if it == nil {
+		s.stats["get_misses"]++
+		return item{}, false
+	}
+	s.stats["get_hits"]++
+	return *it, true
+}
+
+func (s *Server) store(mode string, key string, flags uint32, exptime int64, value []byte, cas uint64) status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats["cmd_set"]++
+	if len(value) > s.ItemSizeMax {
+		return statusTooLarge
+	}
+	it := s.get(key)
+	switch mode {
+	case "add":
+		if it != nil {
+			return statusNotStored
+		}
+	case "replace":
+		if it == nil {
+			return statusNotStored
+		}
+	case "append", "prepend":
+		if it == nil {
+			return statusNotStored
+		}
+		if cas != 0 && cas != it.cas {
+			return statusExists
+		}
+		if mode == "append" {
+			value = append(append([]byte{}, it.value...), value...)
+		} else {
+			value = append(append([]byte{}, value...), it.value...)
+		}
+		it.value = value
+		it.cas = s.nextCAS()
+		return statusStored
+	case "cas":
+		if it == nil {
+			return statusNotFound
+		}
+		if cas != it.cas {
+			return statusExists
+		}
+	}
+	// binary protocol set with cas behaves as cas
+	if mode == "set" && cas != 0 {
+		if it == nil {
+			return statusNotFound
+		}
+		if cas != it.cas {
+			return statusExists
+		}
+	}
+	s.items[key] = &item{value: value, flags: flags, exptime: s.expiry(exptime), cas: s.nextCAS()}
+	s.stats["total_items"]++
+	return statusStored
+}
+
+func (s *Server) delete(key string) status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.get(key) == nil {
+		return statusNotFound
+	}
+	delete(s.items, key)
+	return statusStored
+}
+
+// incr apply delta on a numeric value, create it with initial when create is true
+func (s *Server) incr(key string, delta uint64, decr bool, create bool, initial uint64, exptime int64) (uint64, status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it := s.get(key)
+	if it == nil {
+		if !create {
+			return 0, statusNotFound
+		}
+		value := []byte(strconv.FormatUint(initial, 10))
+		s.items[key] = &item{value: value, exptime: s.expiry(exptime), cas: s.nextCAS()}
+		return initial, statusStored
+	}
+	n, err := strconv.ParseUint(string(it.value), 10, 64)
+	if err != nil {
+		return 0, statusNonNumeric
+	}
+	if decr {
+		if delta > n {
+			n = 0
+		} else {
+			n -= delta
+		}
+	} else {
+		n += delta
+	}
+	it.value = []byte(strconv.FormatUint(n, 10))
+	it.cas = s.nextCAS()
+	return n, statusStored
+}
+
+func (s *Server) touch(key string, exptime int64) (item, status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it := s.get(key)
+	if it == nil {
+		return item{}, statusNotFound
+	}
+	it.exptime = s.expiry(exptime)
+	return *it, statusStored
+}
+
+func (s *Server) flush(delay int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if delay <= 0 {
+		s.items = make(map[string]*item)
+		return
+	}
+	exptime := s.expiry(delay)
+	for _, it := range s.items {
+		if it.exptime.IsZero() || it.exptime.After(exptime) {
+			it.exptime = exptime
+		}
+	}
+}
+
+// statistics return the stats of group, nil if group is unknown
+func (s *Server) statistics(group string) [][2]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	switch group {
+	case "":
+		var bytes uint64
+		for _, it := range s.items {
+			bytes += uint64(len(it.value))
+		}
+		return [][2]string{
+			{"pid", "1"},
+			{"uptime", u(uint64(now.Sub(s.started) / time.Second))},
+			{"time", strconv.FormatInt(now.Unix(), 10)},
+			{"version", Version},
+			{"curr_connections", u(uint64(len(s.conns)))},
+			{"total_connections", u(s.stats["total_connections"])},
+			{"cmd_get", u(s.stats["cmd_get"])},
+			{"cmd_set", u(s.stats["cmd_set"])},
+			{"get_hits", u(s.stats["get_hits"])},
+			{"get_misses", u(s.stats["get_misses"])},
+			{"curr_items", u(uint64(len(s.items)))},
+			{"total_items", u(s.stats["total_items"])},
+			{"bytes", u(bytes)},
+			{"evictions", "0"},
+			{"limit_maxbytes", u(64 * 1024 * 1024)},
+		}
+	case "settings":
+		return [][2]string{
+			{"maxbytes", u(64 * 1024 * 1024)},
+			{"maxconns", "1024"},
+			{"item_size_max", u(uint64(s.ItemSizeMax))},
+			{"evictions", "on"},
+		}
+	case "items":
+		return [][2]string{
+			{"items:1:number", u(uint64(len(s.items)))},
+			{"items:1:evicted", "0"},
+		}
+	case "slabs":
+		return [][2]string{
+			{"1:chunk_size", "96"},
+			{"active_slabs", "1"},
+		}
+	case "detail on", "detail off", "detail dump":
+		return [][2]string{}
+	}
+	if strings.HasPrefix(group, "cachedump ") {
+		stats := make([][2]string, 0, len(s.items))
+		for key, it := range s.items {
+			stats = append(stats, [2]string{key, "[" + strconv.Itoa(len(it.value)) + " b; 0 s]"})
+		}
+		return stats
+	}
+	return nil
+}
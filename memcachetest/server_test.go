@@ -0,0 +1,48 @@
+package memcachetest
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerClock(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("start server error: %v", err)
+	}
+	defer server.Close()
+	now := time.Now()
+	var elapsed int64
+	server.SetClock(func() time.Time { return now.Add(time.Duration(atomic.LoadInt64(&elapsed))) })
+	conn, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatalf("dial server error: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	request := func(command, expect string) {
+		if _, err := conn.Write([]byte(command)); err != nil {
+			t.Fatalf("write %q error: %v", command, err)
+		}
+		for i := 0; i < len(expect); {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read reply of %q error: %v", command, err)
+			}
+			if i+len(line) > len(expect) || line != expect[i:i+len(line)] {
+				t.Fatalf("reply of %q expect: %q but got: %q", command, expect[i:], line)
+			}
+			i += len(line)
+		}
+	}
+	request("set key 1 10 5\r\nvalue\r\n", "STORED\r\n")
+	request("get key\r\n", "VALUE key 1 5\r\nvalue\r\nEND\r\n")
+	atomic.AddInt64(&elapsed, int64(9*time.Second))
+	request("get key\r\n", "VALUE key 1 5\r\nvalue\r\nEND\r\n")
+	atomic.AddInt64(&elapsed, int64(time.Second))
+	request("get key\r\n", "END\r\n")
+	request("version\r\n", "VERSION "+Version+"\r\n")
+}
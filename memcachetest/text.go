@@ -0,0 +1,439 @@
+package memcachetest
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var storeReplies = map[status]string{
+	statusStored:    "STORED",
+	statusNotStored: "NOT_STORED",
+	statusExists:    "EXISTS",
+	statusNotFound:  "NOT_FOUND",
+	statusTooLarge:  "SERVER_ERROR object too large for cache",
+}
+
+func (s *Server) serveText(reader *bufio.Reader, writer *bufio.Writer) {
+	authenticated := !s.authRequired()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			writer.WriteString("ERROR\r\n")
+		} else if !authenticated {
+			if authenticated, err = s.handleTextAuth(fields, reader, writer); err != nil {
+				writer.Flush()
+				return
+			}
+		} else if !s.handleText(fields, reader, writer) {
+			writer.Flush()
+			return
+		}
+		// flush once all pipelined commands are handled
+		if reader.Buffered() == 0 {
+			if err = writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleTextAuth handle a command before authentication, only set with
+// "username password" as value is accepted like memcached -Y does.
+func (s *Server) handleTextAuth(fields []string, reader *bufio.Reader, w *bufio.Writer) (bool, error) {
+	if fields[0] != "set" || len(fields) < 5 {
+		w.WriteString("CLIENT_ERROR unauthenticated\r\n")
+		return false, nil
+	}
+	size, err := strconv.Atoi(fields[4])
+	if err != nil || size < 0 {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return false, nil
+	}
+	value := make([]byte, size+2)
+	if _, err = io.ReadFull(reader, value); err != nil {
+		return false, err
+	}
+	credentials := strings.SplitN(string(value[:size]), " ", 2)
+	if len(credentials) != 2 || !s.checkAuth(credentials[0], credentials[1]) {
+		w.WriteString("CLIENT_ERROR authentication failure\r\n")
+		return false, nil
+	}
+	w.WriteString("STORED\r\n")
+	return true, nil
+}
+
+// handleText handle one command, return false to close the connection
+func (s *Server) handleText(fields []string, reader *bufio.Reader, w *bufio.Writer) bool {
+	noreply := fields[len(fields)-1] == "noreply"
+	reply := func(msg string) {
+		if !noreply {
+			w.WriteString(msg)
+			w.WriteString("\r\n")
+		}
+	}
+	switch cmd := fields[0]; cmd {
+	case "get", "gets":
+		if len(fields) < 2 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		for _, key := range fields[1:] {
+			it, ok := s.lookup(key)
+			if !ok {
+				continue
+			}
+			w.WriteString("VALUE " + key + " " + strconv.FormatUint(uint64(it.flags), 10) + " " + strconv.Itoa(len(it.value)))
+			if cmd == "gets" {
+				w.WriteString(" " + strconv.FormatUint(it.cas, 10))
+			}
+			w.WriteString("\r\n")
+			w.Write(it.value)
+			w.WriteString("\r\n")
+		}
+		w.WriteString("END\r\n")
+	case "set", "add", "replace", "append", "prepend", "cas":
+		args := 5
+		if cmd == "cas" {
+			args = 6
+		}
+		if len(fields) < args {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		flags, err1 := strconv.ParseUint(fields[2], 10, 32)
+		exptime, err2 := strconv.ParseInt(fields[3], 10, 64)
+		size, err3 := strconv.Atoi(fields[4])
+		var cas uint64
+		var err4 error
+		if cmd == "cas" {
+			cas, err4 = strconv.ParseUint(fields[5], 10, 64)
+		}
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return true
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return false
+		}
+		if value[size] != '\r' || value[size+1] != '\n' {
+			w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return true
+		}
+		reply(storeReplies[s.store(cmd, fields[1], uint32(flags), exptime, value[:size], cas)])
+	case "delete":
+		if len(fields) < 2 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		if s.delete(fields[1]) == statusNotFound {
+			reply("NOT_FOUND")
+		} else {
+			reply("DELETED")
+		}
+	case "incr", "decr":
+		if len(fields) < 3 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		delta, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+			return true
+		}
+		n, st := s.incr(fields[1], delta, cmd == "decr", false, 0, 0)
+		switch st {
+		case statusNotFound:
+			reply("NOT_FOUND")
+		case statusNonNumeric:
+			reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+		default:
+			reply(strconv.FormatUint(n, 10))
+		}
+	case "touch":
+		if len(fields) < 3 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		exptime, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR invalid exptime argument\r\n")
+			return true
+		}
+		if _, st := s.touch(fields[1], exptime); st == statusNotFound {
+			reply("NOT_FOUND")
+		} else {
+			reply("TOUCHED")
+		}
+	case "flush_all":
+		var delay int64
+		if len(fields) > 1 && fields[1] != "noreply" {
+			delay, _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+		s.flush(delay)
+		reply("OK")
+	case "version":
+		w.WriteString("VERSION " + Version + "\r\n")
+	case "verbosity":
+		reply("OK")
+	case "stats":
+		group := strings.Join(fields[1:], " ")
+		stats := s.statistics(group)
+		if stats == nil {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		if group == "detail on" || group == "detail off" {
+			reply("OK")
+			return true
+		}
+		prefix := "STAT "
+		if group == "detail dump" {
+			prefix = "PREFIX "
+		} else if strings.HasPrefix(group, "cachedump ") {
+			prefix = "ITEM "
+		}
+		for _, stat := range stats {
+			w.WriteString(prefix + stat[0] + " " + stat[1] + "\r\n")
+		}
+		w.WriteString("END\r\n")
+	case "quit":
+		return false
+	case "mn":
+		w.WriteString("MN\r\n")
+	case "mg":
+		s.metaGet(fields, w)
+	case "ms":
+		return s.metaSet(fields, reader, w)
+	case "md":
+		s.metaDelete(fields, w)
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return true
+}
+
+// metaFlags parse meta command flags into a map from flag to token
+func metaFlags(fields []string) map[byte]string {
+	flags := make(map[byte]string, len(fields))
+	for _, f := range fields {
+		if f != "" {
+			flags[f[0]] = f[1:]
+		}
+	}
+	return flags
+}
+
+func (s *Server) metaGet(fields []string, w *bufio.Writer) {
+	if len(fields) < 2 {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	key := fields[1]
+	flags := metaFlags(fields[2:])
+	var ret []string
+	s.mu.Lock()
+	s.stats["cmd_get"]++
+	it := s.get(key)
+	if it == nil {
+		ttl, ok := flags['N']
+		if !ok {
+			s.stats["get_misses"]++
+			s.mu.Unlock()
+			if _, quiet := flags['q']; !quiet {
+				w.WriteString("EN\r\n")
+			}
+			return
+		}
+		// vivify on miss, this client wins the right to fill the item
+		exptime, _ := strconv.ParseInt(ttl, 10, 64)
+		it = &item{exptime: s.expiry(exptime), cas: s.nextCAS(), vivified: true, won: true}
+		s.items[key] = it
+		ret = append(ret, "W")
+	} else {
+		s.stats["get_hits"]++
+		if it.stale || it.vivified {
+			if !it.won {
+				it.won = true
+				ret = append(ret, "W")
+			} else {
+				ret = append(ret, "Z")
+			}
+		}
+		if it.stale {
+			ret = append(ret, "X")
+		}
+	}
+	if ttl, ok := flags['T']; ok {
+		exptime, _ := strconv.ParseInt(ttl, 10, 64)
+		it.exptime = s.expiry(exptime)
+	}
+	cur := *it
+	now := s.now()
+	s.mu.Unlock()
+	var out []string
+	for _, f := range fields[2:] {
+		switch f[0] {
+		case 'f':
+			out = append(out, "f"+strconv.FormatUint(uint64(cur.flags), 10))
+		case 'c':
+			out = append(out, "c"+strconv.FormatUint(cur.cas, 10))
+		case 's':
+			out = append(out, "s"+strconv.Itoa(len(cur.value)))
+		case 'k':
+			out = append(out, "k"+key)
+		case 'O':
+			out = append(out, f)
+		case 't':
+			ttl := "-1"
+			if !cur.exptime.IsZero() {
+				ttl = strconv.FormatInt(int64(cur.exptime.Sub(now)/time.Second), 10)
+			}
+			out = append(out, "t"+ttl)
+		}
+	}
+	out = append(out, ret...)
+	if _, ok := flags['v']; ok {
+		w.WriteString(strings.Join(append([]string{"VA", strconv.Itoa(len(cur.value))}, out...), " ") + "\r\n")
+		w.Write(cur.value)
+		w.WriteString("\r\n")
+		return
+	}
+	w.WriteString(strings.Join(append([]string{"HD"}, out...), " ") + "\r\n")
+}
+
+func (s *Server) metaSet(fields []string, reader *bufio.Reader, w *bufio.Writer) bool {
+	if len(fields) < 3 {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return true
+	}
+	key := fields[1]
+	size, err := strconv.Atoi(fields[2])
+	if err != nil || size < 0 {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return true
+	}
+	value := make([]byte, size+2)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return false
+	}
+	value = value[:size]
+	flags := metaFlags(fields[3:])
+	_, quiet := flags['q']
+	_, invalidate := flags['I']
+	reply := func(msg string) {
+		if !quiet || msg != "HD" {
+			w.WriteString(msg + "\r\n")
+		}
+	}
+	var exptime int64
+	var clientFlags, cas uint64
+	if v, ok := flags['T']; ok {
+		exptime, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := flags['F']; ok {
+		clientFlags, _ = strconv.ParseUint(v, 10, 32)
+	}
+	if v, ok := flags['C']; ok {
+		cas, _ = strconv.ParseUint(v, 10, 64)
+	}
+	mode := "set"
+	switch flags['M'] {
+	case "E", "e":
+		mode = "add"
+	case "A", "a":
+		mode = "append"
+	case "P", "p":
+		mode = "prepend"
+	case "R", "r":
+		mode = "replace"
+	}
+	if len(value) > s.ItemSizeMax {
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return true
+	}
+	s.mu.Lock()
+	it := s.get(key)
+	if cas != 0 {
+		if it == nil {
+			s.mu.Unlock()
+			reply("NF")
+			return true
+		}
+		if cas != it.cas {
+			// an older cas with invalidation still stores the item but marks it stale
+			if !(invalidate && cas < it.cas) {
+				s.mu.Unlock()
+				reply("EX")
+				return true
+			}
+			s.items[key] = &item{value: value, flags: uint32(clientFlags), exptime: s.expiry(exptime), cas: it.cas, stale: true}
+			s.mu.Unlock()
+			reply("HD")
+			return true
+		}
+		mode = "set"
+		cas = 0
+	}
+	s.mu.Unlock()
+	switch s.store(mode, key, uint32(clientFlags), exptime, value, cas) {
+	case statusStored:
+		reply("HD")
+	case statusExists:
+		reply("EX")
+	case statusNotFound:
+		reply("NF")
+	default:
+		reply("NS")
+	}
+	return true
+}
+
+func (s *Server) metaDelete(fields []string, w *bufio.Writer) {
+	if len(fields) < 2 {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	key := fields[1]
+	flags := metaFlags(fields[2:])
+	_, quiet := flags['q']
+	reply := func(msg string) {
+		if !quiet || msg != "HD" {
+			w.WriteString(msg + "\r\n")
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it := s.get(key)
+	if it == nil {
+		reply("NF")
+		return
+	}
+	if v, ok := flags['C']; ok {
+		if cas, _ := strconv.ParseUint(v, 10, 64); cas != it.cas {
+			reply("EX")
+			return
+		}
+	}
+	if _, ok := flags['I']; ok {
+		// invalidate: keep the item as stale so a single client can recache it
+		it.stale = true
+		it.won = false
+		it.cas = s.nextCAS()
+		if v, ok := flags['T']; ok {
+			exptime, _ := strconv.ParseInt(v, 10, 64)
+			it.exptime = s.expiry(exptime)
+		}
+		reply("HD")
+		return
+	}
+	delete(s.items, key)
+	reply("HD")
+}
@@ -0,0 +1,272 @@
+package gomemcache
+
+// meta commands doc(https://github.com/memcached/memcached/wiki/MetaCommands)
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const defaultLeaseTTL = 30 * time.Second
+
+var (
+	// ErrLeaseNotWon indicates the lease is not won by this client
+	ErrLeaseNotWon = errors.New("lease is not won by this client")
+
+	metaValueDelimiter     = []byte("VA ")
+	metaHeaderDelimiter    = []byte("HD")
+	metaNotFoundDelimiter  = []byte("NF")
+	metaExistsDelimiter    = []byte("EX")
+	metaNotStoredDelimiter = []byte("NS")
+)
+
+// Lease result of GetLease
+type Lease struct {
+	// Item the cached item, it's nil when no value is cached
+	Item *Item
+	// Won reports whether this client won the right to fill the key
+	Won bool
+	// Stale reports whether the item was invalidated
+	Stale bool
+	// Pending reports whether another client won the lease and is filling the key
+	Pending bool
+
+	token uint64
+}
+
+// MetaProtocol implements leases with meta commands of memcached 1.6+,
+// other operations are sent in text protocol.
+type MetaProtocol struct {
+	TextProtocol
+}
+
+// metaRequest send the meta command and return the response line,
+// value is read when the response is VA.
+func (protocol MetaProtocol) metaRequest(key string, command []byte, data []byte) (line []byte, value []byte, err error) {
+	pool := protocol.pools[protocol.getPoolIndex(key)]
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, nil, err
+	}
+	if data != nil {
+		command = append(command, data...)
+		command = append(command, carriageDelimiter, newlineDelimiter)
+	}
+	if _, err = conn.Write(command); err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	line, err = reader.ReadSlice(newlineDelimiter)
+	if err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return nil, nil, err
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	if bytes.HasPrefix(line, metaValueDelimiter) {
+		// VA <size> <flags>*\r\n
+		fields := bytes.Fields(line)
+		if len(fields) < 2 {
+			conn.SetError(ErrInvalidResponseFormat)
+			pool.Put(conn)
+			return nil, nil, ErrInvalidResponseFormat
+		}
+		size, e := strconv.Atoi(string(fields[1]))
+		if e != nil || size < 0 {
+			conn.SetError(ErrInvalidResponseFormat)
+			pool.Put(conn)
+			return nil, nil, ErrInvalidResponseFormat
+		}
+		value = make([]byte, size+2)
+		if _, err = io.ReadFull(reader, value); err != nil {
+			conn.SetError(err)
+			pool.Put(conn)
+			return nil, nil, err
+		}
+		value = value[:size]
+	} else if !bytes.HasPrefix(line, metaHeaderDelimiter) && !bytes.Equal(line, metaNotFoundDelimiter) &&
+		!bytes.Equal(line, metaExistsDelimiter) && !bytes.Equal(line, metaNotStoredDelimiter) {
+		err = replyError(line)
+		// only meta set sends a data block
+		if data == nil || !keepStoreConn(line, err) {
+			conn.SetError(err)
+		}
+		pool.Put(conn)
+		return nil, nil, err
+	}
+	pool.Put(conn)
+	return line, value, nil
+}
+
+// getLease get the item with a vivify on miss of ttl seconds
+func (protocol MetaProtocol) getLease(key string, ttl uint32) (*Lease, error) {
+	command := make([]byte, 0, len(key)+24)
+	command = append(command, "mg "...)
+	command = append(command, key...)
+	command = append(command, " v f c N"...)
+	command = append(command, strconv.FormatUint(uint64(ttl), 10)...)
+	command = append(command, carriageDelimiter, newlineDelimiter)
+	line, value, err := protocol.metaRequest(key, command, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(line, metaValueDelimiter) {
+		return nil, ErrInvalidResponseFormat
+	}
+	lease := new(Lease)
+	item := &Item{Key: key, Value: value}
+	for _, field := range bytes.Fields(line)[2:] {
+		switch field[0] {
+		case 'f':
+			flags, err := strconv.ParseUint(string(field[1:]), 10, 32)
+			if err != nil {
+				return nil, ErrInvalidResponseFormat
+			}
+			item.Flags = uint32(flags)
+		case 'c':
+			cas, err := strconv.ParseUint(string(field[1:]), 10, 64)
+			if err != nil {
+				return nil, ErrInvalidResponseFormat
+			}
+			item.CAS = cas
+		case 'W':
+			lease.Won = true
+		case 'X':
+			lease.Stale = true
+		case 'Z':
+			lease.Pending = true
+		}
+	}
+	lease.token = item.CAS
+	// the item created on miss holds no value
+	if lease.Stale || !(lease.Won || lease.Pending) {
+		lease.Item = item
+	}
+	return lease, nil
+}
+
+// setLease store the item only if its cas still equals the lease token
+func (protocol MetaProtocol) setLease(item *Item, token uint64) error {
+	command := make([]byte, 0, len(item.Key)+64)
+	command = append(command, "ms "...)
+	command = append(command, item.Key...)
+	command = append(command, spaceDelimiter)
+	command = append(command, strconv.Itoa(len(item.Value))...)
+	command = append(command, " T"...)
+	command = append(command, strconv.FormatUint(uint64(item.Expiration), 10)...)
+	command = append(command, " F"...)
+	command = append(command, strconv.FormatUint(uint64(item.Flags), 10)...)
+	command = append(command, " C"...)
+	command = append(command, strconv.FormatUint(token, 10)...)
+	command = append(command, carriageDelimiter, newlineDelimiter)
+	line, _, err := protocol.metaRequest(item.Key, command, item.Value)
+	if err != nil {
+		return err
+	}
+	return metaError(line)
+}
+
+// invalidate mark the item stale for ttl seconds so that one client
+// wins the lease to refill it while others read the stale value.
+func (protocol MetaProtocol) invalidate(key string, ttl uint32) error {
+	command := make([]byte, 0, len(key)+20)
+	command = append(command, "md "...)
+	command = append(command, key...)
+	command = append(command, " I T"...)
+	command = append(command, strconv.FormatUint(uint64(ttl), 10)...)
+	command = append(command, carriageDelimiter, newlineDelimiter)
+	line, _, err := protocol.metaRequest(key, command, nil)
+	if err != nil {
+		return err
+	}
+	return metaError(line)
+}
+
+func metaError(line []byte) error {
+	switch {
+	case bytes.HasPrefix(line, metaHeaderDelimiter):
+		return nil
+	case bytes.Equal(line, metaNotFoundDelimiter):
+		return ErrItemNotFound
+	case bytes.Equal(line, metaExistsDelimiter):
+		return ErrItemExists
+	case bytes.Equal(line, metaNotStoredDelimiter):
+		return ErrItemNotStored
+	}
+	return fmt.Errorf("server response error %s doesn't define", string(line))
+}
+
+// GetLease retrieve the item of key with a lease, it needs the meta protocol.
+// On a miss or a stale item exactly one client wins the lease and should fill
+// the key with SetWithLease, others get the stale item or wait for the value.
+func (client *Client) GetLease(origin string) (*Lease, error) {
+	key, err := client.key(origin)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := client.protocol.(MetaProtocol)
+	if !ok {
+		return nil, ErrOperationNotSupported
+	}
+	lease, err := meta.getLease(key, expirationOf(defaultLeaseTTL))
+	if err != nil || lease.Item == nil {
+		return lease, err
+	}
+	items, err := client.decode([]*Item{lease.Item})
+	if err != nil {
+		return nil, err
+	}
+	lease.Item = nil
+	if len(items) != 0 {
+		lease.Item = items[0]
+		lease.Item.Key = origin
+	}
+	return lease, nil
+}
+
+// SetWithLease store the item with the lease won by GetLease, it returns
+// ErrItemExists if the key has been changed since the lease was granted.
+func (client *Client) SetWithLease(item *Item, lease *Lease) error {
+	key, err := client.key(item.Key)
+	if err != nil {
+		return err
+	}
+	meta, ok := client.protocol.(MetaProtocol)
+	if !ok {
+		return ErrOperationNotSupported
+	}
+	if !lease.Won {
+		return ErrLeaseNotWon
+	}
+	it := *item
+	it.Key = key
+	encoded, err := client.encode(&it)
+	if err != nil {
+		return err
+	}
+	client.invalidateNear(key)
+	return meta.setLease(encoded, lease.token)
+}
+
+// Invalidate mark the item of key stale instead of deleting it, it needs the
+// meta protocol. The next GetLease wins the lease to refill the key and sets
+// with leases granted before are rejected.
+func (client *Client) Invalidate(key string) error {
+	key, err := client.key(key)
+	if err != nil {
+		return err
+	}
+	meta, ok := client.protocol.(MetaProtocol)
+	if !ok {
+		return ErrOperationNotSupported
+	}
+	client.invalidateNear(key)
+	return meta.invalidate(key, expirationOf(defaultLeaseTTL))
+}
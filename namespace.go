@@ -0,0 +1,152 @@
+package gomemcache
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Namespace group keys under a generation so that all of them are
+// invalidated at once, keys are stored as "<name>:<generation>:<key>".
+// Keys of old generations are unreachable and expire or get evicted later.
+type Namespace struct {
+	client Cacher
+	name   string
+	ttl    time.Duration
+
+	mu         sync.Mutex
+	generation string
+	expiresAt  time.Time
+}
+
+// NewNamespace create the namespace of name, the generation is cached in
+// process for ttl, so Invalidate by other processes is seen after ttl.
+// Zero ttl reads the generation from server every time.
+func NewNamespace(client Cacher, name string, ttl time.Duration) *Namespace {
+	return &Namespace{client: client, name: name, ttl: ttl}
+}
+
+func (ns *Namespace) generationKey() string {
+	return ns.name + ":generation"
+}
+
+// currentGeneration return the cached generation or read it from server,
+// a missing generation is initialized with the current unix nanoseconds so
+// that keys of generations evicted before are never reused.
+func (ns *Namespace) currentGeneration() (string, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.generation != "" && nowFunc().Before(ns.expiresAt) {
+		return ns.generation, nil
+	}
+	key := ns.generationKey()
+	// Gets bypasses the near cache of client
+	item, err := ns.client.Gets(key)
+	if err != nil {
+		return "", err
+	}
+	if item == nil {
+		value := []byte(strconv.FormatInt(nowFunc().UnixNano(), 10))
+		err = ns.client.Add(&Item{Key: key, Value: value})
+		if err == nil {
+			ns.cacheGeneration(string(value))
+			return ns.generation, nil
+		}
+		if err != ErrItemNotStored && err != ErrItemExists {
+			return "", err
+		}
+		// another process initialized the generation
+		if item, err = ns.client.Gets(key); err != nil {
+			return "", err
+		}
+		if item == nil {
+			return "", ErrItemNotFound
+		}
+	}
+	ns.cacheGeneration(string(item.Value))
+	return ns.generation, nil
+}
+
+func (ns *Namespace) cacheGeneration(generation string) {
+	ns.generation = generation
+	ns.expiresAt = nowFunc().Add(ns.ttl)
+}
+
+// key return the key stored in server
+func (ns *Namespace) key(generation, key string) string {
+	return ns.name + ":" + generation + ":" + key
+}
+
+// Invalidate make all keys of the namespace unreachable
+func (ns *Namespace) Invalidate() error {
+	generation, err := ns.client.Increment(ns.generationKey(), 1)
+	if err == ErrItemNotFound {
+		// the next read initializes a new generation
+		ns.mu.Lock()
+		ns.generation = ""
+		ns.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ns.mu.Lock()
+	ns.cacheGeneration(strconv.FormatUint(generation, 10))
+	ns.mu.Unlock()
+	return nil
+}
+
+// Get retrieve an item of key in the namespace
+func (ns *Namespace) Get(key string) (*Item, error) {
+	generation, err := ns.currentGeneration()
+	if err != nil {
+		return nil, err
+	}
+	item, err := ns.client.Get(ns.key(generation, key))
+	if item != nil {
+		item.Key = key
+	}
+	return item, err
+}
+
+// MultiGet retrieve bulk items with some keys in the namespace
+func (ns *Namespace) MultiGet(keys []string) ([]*Item, error) {
+	generation, err := ns.currentGeneration()
+	if err != nil {
+		return nil, err
+	}
+	ks := make([]string, 0, len(keys))
+	origin := make(map[string]string, len(keys))
+	for _, key := range keys {
+		k := ns.key(generation, key)
+		ks = append(ks, k)
+		origin[k] = key
+	}
+	items, err := ns.client.MultiGet(ks)
+	for _, item := range items {
+		item.Key = origin[item.Key]
+	}
+	return items, err
+}
+
+// Set store the item in the namespace
+func (ns *Namespace) Set(item *Item) error {
+	generation, err := ns.currentGeneration()
+	if err != nil {
+		return err
+	}
+	it := *item
+	it.Key = ns.key(generation, item.Key)
+	err = ns.client.Set(&it)
+	item.CAS = it.CAS
+	return err
+}
+
+// Delete delete the item of key in the namespace
+func (ns *Namespace) Delete(key string) error {
+	generation, err := ns.currentGeneration()
+	if err != nil {
+		return err
+	}
+	return ns.client.Delete(ns.key(generation, key))
+}
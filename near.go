@@ -0,0 +1,157 @@
+package gomemcache
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// nearShards number of key shards whose invalidations are tracked apart
+const nearShards = 64
+
+// nearGenerations generations of all shards
+type nearGenerations [nearShards]uint64
+
+// nearEntry an item cached in process
+type nearEntry struct {
+	item      *Item
+	size      int
+	expiresAt time.Time
+}
+
+// nearCache bounded LRU cache of items in front of memcached
+type nearCache struct {
+	maxBytes int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	size    int
+	ll      *list.List
+	entries map[string]*list.Element
+	// generations of a shard change on every invalidation of its keys,
+	// fetches started before don't fill the cache with values maybe outdated.
+	generations nearGenerations
+}
+
+func newNearCache(maxBytes int, ttl time.Duration) *nearCache {
+	return &nearCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// copyItem copy the item so that callers can't modify cached values
+func copyItem(item *Item) *Item {
+	it := *item
+	it.Value = append([]byte(nil), item.Value...)
+	return &it
+}
+
+// get return a copy of the cached item of key, nil if it's missing or expired
+func (cache *nearCache) get(key string) *Item {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	elem, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*nearEntry)
+	if !nowFunc().Before(entry.expiresAt) {
+		cache.remove(elem)
+		return nil
+	}
+	cache.ll.MoveToFront(elem)
+	return copyItem(entry.item)
+}
+
+// nearShard return the shard of key
+func nearShard(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % nearShards)
+}
+
+// begin return the generations before fetching items to add
+func (cache *nearCache) begin() nearGenerations {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.generations
+}
+
+// add cache items fetched since generations, items of shards invalidated
+// meanwhile are skipped. Least recently used items are evicted when the
+// cache is full.
+func (cache *nearCache) add(generations nearGenerations, items []*Item) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	expiresAt := nowFunc().Add(cache.ttl)
+	for _, item := range items {
+		shard := nearShard(item.Key)
+		if generations[shard] != cache.generations[shard] {
+			continue
+		}
+		size := len(item.Key) + len(item.Value)
+		if size > cache.maxBytes {
+			continue
+		}
+		if elem, ok := cache.entries[item.Key]; ok {
+			cache.remove(elem)
+		}
+		cache.entries[item.Key] = cache.ll.PushFront(&nearEntry{item: copyItem(item), size: size, expiresAt: expiresAt})
+		cache.size += size
+		for cache.size > cache.maxBytes {
+			cache.remove(cache.ll.Back())
+		}
+	}
+}
+
+// invalidate drop the cached item of key
+func (cache *nearCache) invalidate(key string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.generations[nearShard(key)]++
+	if elem, ok := cache.entries[key]; ok {
+		cache.remove(elem)
+	}
+}
+
+// clear drop all cached items
+func (cache *nearCache) clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for shard := range cache.generations {
+		cache.generations[shard]++
+	}
+	cache.size = 0
+	cache.ll.Init()
+	cache.entries = make(map[string]*list.Element)
+}
+
+func (cache *nearCache) remove(elem *list.Element) {
+	entry := cache.ll.Remove(elem).(*nearEntry)
+	delete(cache.entries, entry.item.Key)
+	cache.size -= entry.size
+}
+
+// SetNearCache keep items read by Get and MultiGet in process for at most
+// ttl, the cache holds up to maxBytes of keys and values and evicts the
+// least recently used items. Items are invalidated by Set, Add, Replace,
+// CAS and Delete of this client only, changes by other clients are seen
+// after ttl. Zero maxBytes or ttl disables the near cache.
+func (client *Client) SetNearCache(maxBytes int, ttl time.Duration) {
+	if maxBytes <= 0 || ttl <= 0 {
+		client.near = nil
+		return
+	}
+	client.near = newNearCache(maxBytes, ttl)
+}
+
+// invalidateNear drop key from the near cache if it's enabled
+func (client *Client) invalidateNear(key string) {
+	if client.near != nil {
+		client.near.invalidate(key)
+	}
+}
@@ -14,6 +14,7 @@ var (
 	// ErrPoolExhausted idle connection pool exhausted
 	ErrPoolExhausted = errors.New("connection pool exhausted")
 	errPoolClosed    = errors.New("pool is closed ")
+	errConnCanceled  = errors.New("connection canceled")
 	// https://github.com/valyala/fasthttp/blob/master/coarseTime.go
 	coarseTime atomic.Value
 )
@@ -38,8 +39,9 @@ type Pool struct {
 // Conn net connection with idle timeout
 type idleConn struct {
 	Conn
-	err    error
-	idleAt time.Time
+	err     error
+	idleAt  time.Time
+	unwatch func()
 }
 
 func (conn *idleConn) SetError(err error) {
@@ -50,17 +52,45 @@ func (conn *idleConn) CheckError() bool {
 	return conn.err != nil
 }
 
+// watch set a past deadline on the connection once cancel is closed, which
+// fails the pending read or write. The canceled connection is closed by Put.
+func (conn *idleConn) watch(cancel <-chan struct{}) {
+	if cancel == nil {
+		return
+	}
+	done := make(chan struct{})
+	canceled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-cancel:
+			conn.Conn.SetDeadline(time.Unix(1, 0))
+			canceled <- true
+		case <-done:
+			canceled <- false
+		}
+	}()
+	conn.unwatch = func() {
+		close(done)
+		if <-canceled {
+			conn.SetError(errConnCanceled)
+		}
+		conn.unwatch = nil
+	}
+}
+
 // Get get a connection from idle conns
 func (pool *Pool) Get() (*idleConn, error) {
+	pool.mu.Lock()
 	if pool.closed {
+		pool.mu.Unlock()
 		return nil, errPoolClosed
 	}
 	if pool.activeConns > pool.MaxActiveConns {
 		log.Printf("max active conns: %d, current active conns: %d, current idle conns: %d",
 			pool.MaxActiveConns, pool.activeConns, len(pool.idleConns))
+		pool.mu.Unlock()
 		return nil, ErrPoolExhausted
 	}
-	pool.mu.Lock()
 	expiredSince := nowFunc().Add(-pool.IdleTimeout)
 	index := len(pool.idleConns)
 	for idx, ic := range pool.idleConns {
@@ -79,18 +109,23 @@ func (pool *Pool) Get() (*idleConn, error) {
 	pool.idleConns = pool.idleConns[index:]
 	numIdle := len(pool.idleConns)
 	if numIdle == 0 {
+		// the slot is reserved so that dialing, which may authenticate,
+		// doesn't block other callers of the pool
+		pool.activeConns++
+		pool.mu.Unlock()
 		c, err := pool.DialFunc()
-		if err != nil {
-			pool.mu.Unlock()
-			return nil, err
+		if err == nil {
+			if err = c.SetDeadline(nowFunc().Add(pool.SocketTimeout)); err != nil {
+				c.Close()
+			}
 		}
-		if err = c.SetDeadline(nowFunc().Add(pool.SocketTimeout)); err != nil {
-			pool.mu.Unlock()
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		if err != nil {
+			pool.activeConns--
 			return nil, err
 		}
-		pool.activeConns++
 		log.Printf("after create new client, current active conns: %d", pool.activeConns)
-		pool.mu.Unlock()
 		return &idleConn{Conn: c}, nil
 	}
 	pool.activeConns++
@@ -106,6 +141,9 @@ func (pool *Pool) Get() (*idleConn, error) {
 
 // Put put an idle conn into idle conns
 func (pool *Pool) Put(ic *idleConn) error {
+	if ic.unwatch != nil {
+		ic.unwatch()
+	}
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 	pool.activeConns--
@@ -117,6 +155,26 @@ func (pool *Pool) Put(ic *idleConn) error {
 	return nil
 }
 
+// PoolStats statistics of connections in pool
+type PoolStats struct {
+	ActiveConns    int `json:"active_conns"`
+	IdleConns      int `json:"idle_conns"`
+	MaxActiveConns int `json:"max_active_conns"`
+	MaxIdleConns   int `json:"max_idle_conns"`
+}
+
+// Stats return the statistics of connections in pool
+func (pool *Pool) Stats() PoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return PoolStats{
+		ActiveConns:    pool.activeConns,
+		IdleConns:      len(pool.idleConns),
+		MaxActiveConns: pool.MaxActiveConns,
+		MaxIdleConns:   pool.MaxIdleConns,
+	}
+}
+
 // Close close all connections in pool
 func (pool *Pool) Close() error {
 	pool.mu.Lock()
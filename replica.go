@@ -0,0 +1,233 @@
+package gomemcache
+
+import (
+	"bytes"
+	"sync"
+)
+
+// SetReplicas keep n copies of every item, on the server of the key and the
+// n-1 servers following it. Set and Delete write all copies, a copy failing
+// to store the item is deleted so that it never serves the old value. Add,
+// Replace, CAS, Increment, Decrement and Set of items read by Gets with
+// binary protocol are decided by the first server, then the other copies
+// apply the same change and the ones rejecting it are deleted. SetFromReader
+// updates the first server and deletes the other copies. Writes return an
+// error when any copy may keep an outdated value.
+// Reads go to the next copy on a miss or an error.
+// n is capped by the number of servers, 1 keeps a single copy by default.
+func (client *Client) SetReplicas(n int) {
+	if n > len(client.servers) {
+		n = len(client.servers)
+	}
+	if n < 1 {
+		n = 1
+	}
+	client.replicas = n
+}
+
+// replicaIndex return the index of the server holding the i-th copy of key
+func (client *Client) replicaIndex(key string, i int) int {
+	return (client.protocol.serverIndex(key) + i) % len(client.servers)
+}
+
+// store store the item to every copy of its key
+func (client *Client) store(cmd string, item *Item) error {
+	if client.replicas <= 1 {
+		return client.protocol.store(cmd, item)
+	}
+	switch cmd {
+	case "set", "setq":
+		// sets of items read by Gets are conditional on binary protocol
+		if item.CAS == 0 {
+			return client.setReplicas(cmd, item)
+		}
+	case "delete", "deleteq":
+		return client.deleteReplicas(cmd, item.Key)
+	}
+	delta := item.Value
+	// the first server decides
+	if err := client.protocol.store(cmd, item); err != nil {
+		return err
+	}
+	var firstErr error
+	for i := 1; i < client.replicas; i++ {
+		index := client.replicaIndex(item.Key, i)
+		copied := *item
+		copied.CAS = 0
+		replicaCmd := cmd
+		switch cmd {
+		case "set", "setq", "cas":
+			// CAS unique of the first server doesn't apply to other copies
+			replicaCmd = "set"
+		case "increment", "decrement":
+			copied.Value = delta
+		}
+		err := client.protocol.storeToServer(index, replicaCmd, &copied)
+		switch {
+		case err == nil && (cmd == "increment" || cmd == "decrement") && !bytes.Equal(copied.Value, item.Value):
+			// the copy diverged from the first server
+		case err == nil:
+			continue
+		case err == ErrItemNotFound || (cmd == "replace" && err == ErrItemNotStored):
+			// nothing to read on copies missing the key
+			continue
+		}
+		if err = client.dropCopy(index, item.Key); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// setReplicas set the item on every copy concurrently, copies failing to
+// store it are deleted. It returns the error of the first copy which may
+// keep its old value, or the error of the first server if no copy is stored.
+func (client *Client) setReplicas(cmd string, item *Item) error {
+	stored := make([]error, client.replicas)
+	errs := client.eachReplica(item.Key, func(i, index int) error {
+		it := item
+		if i != 0 {
+			// replicas don't share the item
+			copied := *item
+			copied.CAS = 0
+			it = &copied
+		}
+		if stored[i] = client.protocol.storeToServer(index, cmd, it); stored[i] != nil {
+			return client.dropCopy(index, item.Key)
+		}
+		return nil
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	for _, err := range stored {
+		if err == nil {
+			return nil
+		}
+	}
+	return stored[0]
+}
+
+// deleteReplicas delete the key on every copy concurrently, it returns
+// ErrItemNotFound only if no copy holds the key.
+func (client *Client) deleteReplicas(cmd string, key string) error {
+	errs := client.eachReplica(key, func(i, index int) error {
+		return client.protocol.storeToServer(index, cmd, &Item{Key: key})
+	})
+	missing := 0
+	for _, err := range errs {
+		if err == ErrItemNotFound {
+			missing++
+		} else if err != nil {
+			return err
+		}
+	}
+	if missing == len(errs) {
+		return ErrItemNotFound
+	}
+	return nil
+}
+
+// eachReplica call fn with the i-th copy and the index of its server
+// concurrently, errors are returned in order of copies.
+func (client *Client) eachReplica(key string, fn func(i, index int) error) []error {
+	errs := make([]error, client.replicas)
+	var wg sync.WaitGroup
+	for i := 0; i < client.replicas; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i, client.replicaIndex(key, i))
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// dropReplicas delete the copies of key except the one on the first server
+func (client *Client) dropReplicas(key string) error {
+	errs := client.eachReplica(key, func(i, index int) error {
+		if i == 0 {
+			return nil
+		}
+		return client.dropCopy(index, key)
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropCopy delete the copy of key on the server of index, it's nil when the
+// copy doesn't exist.
+func (client *Client) dropCopy(index int, key string) error {
+	err := client.protocol.storeToServer(index, "delete", &Item{Key: key})
+	if err == ErrItemNotFound {
+		return nil
+	}
+	return err
+}
+
+// fetch retrieve items of keys, keys missed or failed are read from the next
+// copy, the first read is hedged if SetHedging is enabled.
+func (client *Client) fetch(keys []string, withCAS bool) ([]*Item, error) {
+	if client.replicas <= 1 {
+		return client.protocol.fetch(keys, withCAS)
+	}
+	var mu sync.Mutex
+	var results []*Item
+	// failed errors of keys whose last read failed
+	failed := make(map[string]error)
+	pending := keys
+	for i := 0; i < client.replicas && len(pending) != 0; i++ {
+		groups := make(map[int][]string)
+		for _, key := range pending {
+			index := client.replicaIndex(key, i)
+			groups[index] = append(groups[index], key)
+		}
+		found := make(map[string]struct{})
+		var wg sync.WaitGroup
+		for index, ks := range groups {
+			wg.Add(1)
+			go func(index int, ks []string) {
+				defer wg.Done()
+				var items []*Item
+				var err error
+				if i == 0 && client.hedgeDelay != 0 && !withCAS {
+					items, err = client.hedgedFetch(index, client.replicaIndex(ks[0], 1), ks)
+				} else {
+					items, err = client.protocol.fetchFromServer(index, ks, withCAS, nil)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				for _, key := range ks {
+					if err != nil {
+						failed[key] = err
+					} else {
+						delete(failed, key)
+					}
+				}
+				for _, item := range items {
+					found[item.Key] = struct{}{}
+				}
+				results = append(results, items...)
+			}(index, ks)
+		}
+		wg.Wait()
+		next := make([]string, 0, len(pending)-len(found))
+		for _, key := range pending {
+			if _, ok := found[key]; !ok {
+				next = append(next, key)
+			}
+		}
+		pending = next
+	}
+	for _, err := range failed {
+		return results, err
+	}
+	return results, nil
+}
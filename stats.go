@@ -0,0 +1,120 @@
+package gomemcache
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ServerErrors errors of servers keyed by server address
+type ServerErrors map[string]error
+
+func (errs ServerErrors) Error() string {
+	servers := make([]string, 0, len(errs))
+	for server := range errs {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	messages := make([]string, 0, len(servers))
+	for _, server := range servers {
+		messages = append(messages, server+": "+errs[server].Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// eachServer call fn for every server concurrently, errors are returned
+// as ServerErrors.
+func (client *Client) eachServer(fn func(index int, server string) error) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	errs := make(ServerErrors)
+	for index, server := range client.servers {
+		wg.Add(1)
+		go func(index int, server string) {
+			defer wg.Done()
+			if err := fn(index, server); err != nil {
+				mu.Lock()
+				errs[server] = err
+				mu.Unlock()
+			}
+		}(index, server)
+	}
+	wg.Wait()
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// ServerStats retrieve statistics of group from every server keyed by server
+// address, group is one of "", "items", "slabs", "settings", "detail dump",
+// "cachedump 1 0" and so on, the empty group is the general-purpose
+// statistics. Lines of dumps are keyed by their second field. Results of
+// servers which respond are returned with ServerErrors of the others.
+func (client *Client) ServerStats(group string) (map[string]map[string]string, error) {
+	if !validStatsGroup(group) {
+		return nil, ErrInvalidKey
+	}
+	var mu sync.Mutex
+	results := make(map[string]map[string]string, len(client.servers))
+	err := client.eachServer(func(index int, server string) error {
+		stats, err := client.protocol.stats(index, group)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		results[server] = stats
+		mu.Unlock()
+		return nil
+	})
+	return results, err
+}
+
+// validStatsGroup reports whether group can be sent as arguments of stats,
+// it can't contain control characters.
+func validStatsGroup(group string) bool {
+	if len(group) > 250 {
+		return false
+	}
+	for i := 0; i < len(group); i++ {
+		if group[i] < ' ' || group[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Stats general-purpose statistics of a server, such as Stats(results[server])
+// of results returned by ServerStats("").
+type Stats map[string]string
+
+// Uint64 return the statistic of name, 0 if it's missing or not a number
+func (stats Stats) Uint64(name string) uint64 {
+	value, _ := strconv.ParseUint(stats[name], 10, 64)
+	return value
+}
+
+// HitRatio return get_hits / (get_hits + get_misses), 0 if there is no get
+func (stats Stats) HitRatio() float64 {
+	hits, misses := stats.Uint64("get_hits"), stats.Uint64("get_misses")
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// Evictions return the number of items evicted to free memory
+func (stats Stats) Evictions() uint64 {
+	return stats.Uint64("evictions")
+}
+
+// CurrItems return the number of items currently stored
+func (stats Stats) CurrItems() uint64 {
+	return stats.Uint64("curr_items")
+}
+
+// Bytes return the number of bytes used to store items
+func (stats Stats) Bytes() uint64 {
+	return stats.Uint64("bytes")
+}
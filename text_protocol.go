@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
 	"sync"
 )
@@ -25,8 +26,17 @@ const (
 )
 
 var (
-	noReplyDelimiter = []byte("noreply")
+	noReplyDelimiter     = []byte("noreply")
+	crlfDelimiter        = []byte("\r\n")
+	serverErrorDelimiter = []byte("SERVER_ERROR")
+	errorDelimiters      = [][]byte{[]byte("ERROR"), serverErrorDelimiter, []byte("CLIENT_ERROR")}
+	// prefixes of lines replied by stats, "stats cachedump" and "stats detail dump"
+	statDelimiters = [][]byte{statDelimiter, []byte("ITEM"), []byte("PREFIX")}
 
+	okDelimiter        = []byte("OK\r\n")
+	valueDelimiter     = []byte("VALUE ")
+	statDelimiter      = []byte("STAT")
+	versionDelimiter   = []byte("VERSION ")
 	endDelimiter       = []byte("END\r\n")
 	existsDelimiter    = []byte("EXISTS\r\n")
 	storedDelimiter    = []byte("STORED\r\n")
@@ -40,6 +50,23 @@ type TextProtocol struct {
 }
 
 func (protocol TextProtocol) store(cmd string, item *Item) error {
+	return protocol.storeFrom(cmd, item, int64(len(item.Value)), nil)
+}
+
+// storeFrom store the item with size bytes value read from r,
+// item.Value is used when r is nil.
+func (protocol TextProtocol) storeFrom(cmd string, item *Item, size int64, r io.Reader) error {
+	return protocol.storeFromServer(protocol.serverIndex(item.Key), cmd, item, size, r)
+}
+
+// storeToServer store the item to the server of index
+func (protocol TextProtocol) storeToServer(index int, cmd string, item *Item) error {
+	return protocol.storeFromServer(index, cmd, item, int64(len(item.Value)), nil)
+}
+
+// storeFromServer store the item with size bytes value read from r to the
+// server of index, item.Value is used when r is nil.
+func (protocol TextProtocol) storeFromServer(index int, cmd string, item *Item, size int64, r io.Reader) error {
 	op, ok := operations[cmd]
 	if !ok {
 		return ErrOperationNotSupported
@@ -55,28 +82,24 @@ func (protocol TextProtocol) store(cmd string, item *Item) error {
 		buf = append(buf, spaceDelimiter)
 		buf = append(buf, strconv.FormatUint(uint64(item.Expiration), 10)...)
 		buf = append(buf, spaceDelimiter)
-		buf = append(buf, strconv.Itoa(len(item.Value))...)
+		buf = append(buf, strconv.FormatInt(size, 10)...)
 		buf = append(buf, spaceDelimiter)
 		if op.command == casCmd {
 			buf = append(buf, strconv.FormatUint(item.CAS, 10)...)
 			buf = append(buf, spaceDelimiter)
 		}
 	} else if op.command == incrCmd || op.command == decrCmd {
-		buf = append(buf, strconv.Itoa(len(item.Value))...)
+		buf = append(buf, item.Value...)
 		buf = append(buf, spaceDelimiter)
 	}
 	if op.quiet {
 		buf = append(buf, noReplyDelimiter...)
 	}
 	buf = append(buf, carriageDelimiter, newlineDelimiter)
-	if isStored {
+	if isStored && r == nil {
 		buf = append(buf, item.Value...)
 		buf = append(buf, carriageDelimiter, newlineDelimiter)
 	}
-	var index uint32
-	if protocol.poolSize != 1 {
-		index = protocol.getPoolIndex(item.Key)
-	}
 	pool := protocol.pools[index]
 	conn, err := pool.Get()
 	if err != nil {
@@ -87,21 +110,206 @@ func (protocol TextProtocol) store(cmd string, item *Item) error {
 		pool.Put(conn)
 		return err
 	}
+	if isStored && r != nil {
+		// the data block is partially sent when copy fails, so drop the connection
+		if _, err = io.CopyN(conn, r, size); err == nil {
+			_, err = conn.Write(crlfDelimiter)
+		}
+		if err != nil {
+			conn.SetError(err)
+			pool.Put(conn)
+			return err
+		}
+	}
 	if op.quiet {
 		pool.Put(conn)
 		return nil
 	}
-	// 12 is the max bytes size read from server
-	b := make([]byte, 12)
-	n, err := conn.Read(b)
-	err = protocol.checkError(b[:n], err)
-	if err == ErrOperationNotSupported {
+	line, err := bufio.NewReader(conn).ReadSlice(newlineDelimiter)
+	if err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return err
+	}
+	if (op.command == incrCmd || op.command == decrCmd) && line[0] >= '0' && line[0] <= '9' {
+		// the new value responses incr and decr
+		item.Value = append([]byte(nil), bytes.TrimRight(line, "\r\n")...)
+		pool.Put(conn)
+		return nil
+	}
+	err = protocol.checkError(line, nil)
+	if !keepStoreConn(line, err) {
 		conn.SetError(err)
 	}
 	pool.Put(conn)
 	return err
 }
 
+// stats retrieve the statistics of group from the server of index,
+// an empty group is the general-purpose statistics
+func (protocol TextProtocol) stats(index int, group string) (map[string]string, error) {
+	buf := []byte("stats")
+	if group != "" {
+		buf = append(buf, spaceDelimiter)
+		buf = append(buf, group...)
+	}
+	buf = append(buf, carriageDelimiter, newlineDelimiter)
+	pool := protocol.pools[index]
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(buf); err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	stats := make(map[string]string)
+	for {
+		line, err := reader.ReadSlice(newlineDelimiter)
+		if err != nil {
+			conn.SetError(err)
+			pool.Put(conn)
+			return nil, err
+		}
+		// "stats detail on" and "stats detail off" reply OK only
+		if bytes.Equal(line, endDelimiter) || (len(stats) == 0 && bytes.Equal(line, okDelimiter)) {
+			break
+		}
+		// STAT <name> <value>\r\n
+		fields := bytes.SplitN(bytes.TrimRight(line, "\r\n"), []byte{spaceDelimiter}, 3)
+		if len(fields) < 2 || !isStatLine(fields[0]) {
+			err = replyError(line)
+			if !keepConn(err) {
+				conn.SetError(err)
+			}
+			pool.Put(conn)
+			return nil, err
+		}
+		value := ""
+		if len(fields) == 3 {
+			value = string(fields[2])
+		}
+		stats[string(fields[1])] = value
+	}
+	pool.Put(conn)
+	return stats, nil
+}
+
+// command send cmd to the server of index and return the response line,
+// lines without the expected prefix are returned as errors
+func (protocol TextProtocol) command(index int, cmd string, expect []byte) ([]byte, error) {
+	pool := protocol.pools[index]
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write([]byte(cmd + "\r\n")); err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadSlice(newlineDelimiter)
+	if err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return nil, err
+	}
+	if !bytes.HasPrefix(line, expect) {
+		err = replyError(line)
+		if !keepConn(err) {
+			conn.SetError(err)
+		}
+		pool.Put(conn)
+		return nil, err
+	}
+	pool.Put(conn)
+	return line, nil
+}
+
+// flushAll invalidate all items of the server of index after delay seconds
+func (protocol TextProtocol) flushAll(index int, delay uint32) error {
+	cmd := "flush_all"
+	if delay != 0 {
+		cmd += " " + strconv.FormatUint(uint64(delay), 10)
+	}
+	_, err := protocol.command(index, cmd, okDelimiter)
+	return err
+}
+
+// version return the version of the server of index
+func (protocol TextProtocol) version(index int) (string, error) {
+	line, err := protocol.command(index, "version", versionDelimiter)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(line[len(versionDelimiter):], "\r\n")), nil
+}
+
+// noop check the server of index responds, text protocol has no noop
+// command so version is sent
+func (protocol TextProtocol) noop(index int) error {
+	_, err := protocol.version(index)
+	return err
+}
+
+// replyError return the error of an unexpected reply line, error replies
+// of server are returned as ServerError
+// isStatLine reports whether prefix starts a line of stats
+func isStatLine(prefix []byte) bool {
+	for _, delimiter := range statDelimiters {
+		if bytes.Equal(prefix, delimiter) {
+			return true
+		}
+	}
+	return false
+}
+
+func replyError(line []byte) error {
+	for _, prefix := range errorDelimiters {
+		if bytes.HasPrefix(line, prefix) {
+			return ServerError(bytes.TrimRight(line, "\r\n"))
+		}
+	}
+	return fmt.Errorf("server response error %s doesn't define", string(line))
+}
+
+// keepConn reports whether the connection is still in sync after err,
+// otherwise it must be dropped. Error replies of server may leave data
+// unread, such as the rest of a multi-get or a data block taken as a
+// command, so they drop the connection.
+func keepConn(err error) bool {
+	return err == nil || err == ErrItemNotStored || err == ErrItemExists || err == ErrItemNotFound
+}
+
+// keepStoreConn reports whether the connection is still in sync after the
+// reply line of a store command, the data block is swallowed by server
+// before a SERVER_ERROR reply such as too large values.
+func keepStoreConn(line []byte, err error) bool {
+	return keepConn(err) || bytes.HasPrefix(line, serverErrorDelimiter)
+}
+
+// textAuth authenticate conn by a set command whose value is "username password",
+// it's accepted by memcached started with an auth file (-Y).
+func textAuth(conn net.Conn, username, password string) error {
+	payload := username + " " + password
+	if _, err := conn.Write([]byte("set auth 0 0 " + strconv.Itoa(len(payload)) + "\r\n" + payload + "\r\n")); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadSlice(newlineDelimiter)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(line, storedDelimiter) {
+		return nil
+	}
+	if bytes.HasPrefix(line, []byte("CLIENT_ERROR")) {
+		return ErrAuthFailed
+	}
+	return replyError(line)
+}
+
 func (protocol TextProtocol) checkError(buf []byte, err error) error {
 	if err != nil {
 		return err
@@ -121,42 +329,50 @@ func (protocol TextProtocol) checkError(buf []byte, err error) error {
 	if bytes.Equal(buf, deletedDelimiter) {
 		return nil
 	}
-	return fmt.Errorf("server response error %s doesn't define", string(buf))
+	return replyError(buf)
 }
 
 func (protocol TextProtocol) fetch(keys []string, withCAS bool) ([]*Item, error) {
-	if protocol.poolSize == 1 {
-		return protocol.fetchFromServer(0, keys, withCAS)
-	}
-	array := make([][]string, protocol.poolSize)
-	for _, key := range keys {
-		index := protocol.getPoolIndex(key)
-		array[index] = append(array[index], key)
-	}
-	var wg sync.WaitGroup
-	var err error
+	var mu sync.Mutex
 	results := make([]*Item, 0, len(keys))
-	for index, ks := range array {
-		if ks == nil {
-			continue
-		}
-		wg.Add(1)
-		go func(idx int, iks []string, cas bool) {
-			result, e := protocol.fetchFromServer(idx, iks, cas)
-			if e != nil {
-				err = e
-			}
-			if len(result) != 0 {
-				results = append(results, result...)
-			}
-			wg.Done()
-		}(index, ks, withCAS)
-	}
-	wg.Wait()
+	err := protocol.fanOut(keys, func(index int, ks []string) error {
+		result, err := protocol.fetchFromServer(index, ks, withCAS, nil)
+		if len(result) != 0 {
+			mu.Lock()
+			results = append(results, result...)
+			mu.Unlock()
+		}
+		return err
+	})
 	return results, err
 }
 
-func (protocol TextProtocol) fetchFromServer(index int, keys []string, withCAS bool) ([]*Item, error) {
+func (protocol TextProtocol) fetchFromServer(index int, keys []string, withCAS bool, cancel <-chan struct{}) ([]*Item, error) {
+	result := make([]*Item, 0, len(keys))
+	err := protocol.scanFromServer(index, keys, withCAS, nil, cancel, func(item *Item) {
+		result = append(result, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (protocol TextProtocol) scan(keys []string, withCAS bool, buf []byte, fn func(item *Item)) error {
+	var mu sync.Mutex
+	return protocol.fanOut(keys, func(index int, ks []string) error {
+		return protocol.scanFromServer(index, ks, withCAS, protocol.scanBuffer(keys, buf), nil, func(item *Item) {
+			mu.Lock()
+			fn(item)
+			mu.Unlock()
+		})
+	})
+}
+
+// scanFromServer call fn for every item found. When buf is nil every item
+// is newly allocated, otherwise the item and its value stored in buf are
+// reused and only valid during fn. The read fails once cancel is closed.
+func (protocol TextProtocol) scanFromServer(index int, keys []string, withCAS bool, buf []byte, cancel <-chan struct{}, fn func(item *Item)) error {
 	var cmd string
 	if withCAS {
 		cmd = getsCmd
@@ -168,71 +384,162 @@ func (protocol TextProtocol) fetchFromServer(index int, keys []string, withCAS b
 	for i := 0; i < count; i++ {
 		length += len(keys[i])
 	}
-	buf := make([]byte, 0, length+2)
-	buf = append(buf, cmd...)
+	command := make([]byte, 0, length+2)
+	command = append(command, cmd...)
 	for _, key := range keys {
-		buf = append(buf, spaceDelimiter)
-		buf = append(buf, key...)
+		command = append(command, spaceDelimiter)
+		command = append(command, key...)
 	}
-	buf = append(buf, carriageDelimiter, newlineDelimiter)
+	command = append(command, carriageDelimiter, newlineDelimiter)
 	pool := protocol.pools[index]
 	conn, err := pool.Get()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	conn.watch(cancel)
 	var total int
 	for {
-		c, err := conn.Write(buf[total:])
+		c, err := conn.Write(command[total:])
 		if err != nil {
 			conn.SetError(err)
 			pool.Put(conn)
-			return nil, err
+			return err
 		}
 		total += c
-		if total == len(buf) {
+		if total == len(command) {
 			break
 		}
 	}
-	result := make([]*Item, 0, len(keys))
+	var reused *Item
+	if buf != nil {
+		reused = new(Item)
+	}
 	reader := bufio.NewReader(conn)
 	for {
 		line, err := reader.ReadSlice(newlineDelimiter)
 		if err != nil {
 			conn.SetError(err)
 			pool.Put(conn)
-			return nil, err
+			return err
 		}
 		if bytes.Equal(line, endDelimiter) {
 			pool.Put(conn)
-			return result, nil
-		}
-		var key string
-		var cas uint64
-		var num, size, flags int
-		// line contains "VALUE <key> <flags> <bytes> [<cas unique>]\r\n"
-		for idx, row := range line[6 : len(line)-2] {
-			if row == spaceDelimiter || row == carriageDelimiter {
-				if num == 0 {
-					key = string(line[6 : 6+idx])
-				}
-				num++
-			} else if num == 1 {
-				flags = flags*10 + int(row-zeroDelimiter)
-			} else if num == 2 {
-				size = size*10 + int(row-zeroDelimiter)
-			} else if num == 3 {
-				cas = cas*10 + uint64(row-zeroDelimiter)
+			return nil
+		}
+		if !isValueLine(line) {
+			err = replyError(line)
+			if !keepConn(err) {
+				conn.SetError(err)
+			}
+			pool.Put(conn)
+			return err
+		}
+		key, flags, size, cas := parseValueLine(line)
+		var value []byte
+		if buf == nil {
+			value = make([]byte, size+2)
+		} else {
+			if cap(buf) < size+2 {
+				buf = make([]byte, size+2)
 			}
+			value = buf[:size+2]
 		}
-		value := make([]byte, size+2)
 		// include the delimiter \r\n
 		n, err := io.ReadFull(reader, value)
 		if err != nil || n != size+2 {
 			conn.SetError(err)
 			pool.Put(conn)
-			return nil, err
+			return err
 		}
-		item := &Item{Key: key, Value: value[:size], Flags: uint32(flags), CAS: cas}
-		result = append(result, item)
+		item := reused
+		if item == nil {
+			item = new(Item)
+		}
+		*item = Item{Key: key, Value: value[:size], Flags: flags, CAS: cas}
+		fn(item)
+	}
+}
+
+// isValueLine reports whether line can be parsed by parseValueLine
+func isValueLine(line []byte) bool {
+	return len(line) > len(valueDelimiter)+2 && bytes.HasPrefix(line, valueDelimiter) && bytes.HasSuffix(line, crlfDelimiter)
+}
+
+// parseValueLine parse line "VALUE <key> <flags> <bytes> [<cas unique>]\r\n"
+func parseValueLine(line []byte) (key string, flags uint32, size int, cas uint64) {
+	var num int
+	for idx, row := range line[6 : len(line)-2] {
+		if row == spaceDelimiter || row == carriageDelimiter {
+			if num == 0 {
+				key = string(line[6 : 6+idx])
+			}
+			num++
+		} else if num == 1 {
+			flags = flags*10 + uint32(row-zeroDelimiter)
+		} else if num == 2 {
+			size = size*10 + int(row-zeroDelimiter)
+		} else if num == 3 {
+			cas = cas*10 + uint64(row-zeroDelimiter)
+		}
+	}
+	return key, flags, size, cas
+}
+
+// fetchTo write the value of key to the writer chosen by the item flags,
+// it returns ErrItemNotFound on miss
+func (protocol TextProtocol) fetchTo(key string, writer func(flags uint32) io.Writer) (uint32, error) {
+	pool := protocol.pools[protocol.getPoolIndex(key)]
+	conn, err := pool.Get()
+	if err != nil {
+		return 0, err
+	}
+	command := make([]byte, 0, len(getCmd)+len(key)+3)
+	command = append(command, getCmd...)
+	command = append(command, spaceDelimiter)
+	command = append(command, key...)
+	command = append(command, carriageDelimiter, newlineDelimiter)
+	if _, err = conn.Write(command); err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return 0, err
+	}
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadSlice(newlineDelimiter)
+	if err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return 0, err
+	}
+	if bytes.Equal(line, endDelimiter) {
+		pool.Put(conn)
+		return 0, ErrItemNotFound
+	}
+	if !isValueLine(line) {
+		err = replyError(line)
+		if !keepConn(err) {
+			conn.SetError(err)
+		}
+		pool.Put(conn)
+		return 0, err
+	}
+	_, flags, size, _ := parseValueLine(line)
+	if _, err = io.CopyN(writer(flags), reader, int64(size)); err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return 0, err
 	}
+	// the rest is "\r\nEND\r\n"
+	tail := make([]byte, len(crlfDelimiter)+len(endDelimiter))
+	if _, err = io.ReadFull(reader, tail); err != nil {
+		conn.SetError(err)
+		pool.Put(conn)
+		return 0, err
+	}
+	if !bytes.Equal(tail[2:], endDelimiter) {
+		conn.SetError(ErrInvalidResponseFormat)
+		pool.Put(conn)
+		return 0, ErrInvalidResponseFormat
+	}
+	pool.Put(conn)
+	return flags, nil
 }
@@ -0,0 +1,81 @@
+package gomemcache
+
+import (
+	"context"
+	"time"
+)
+
+// Typed wrap Cacher to read and write values of type T, values are
+// marshaled by the codec registered for the flags given to NewTyped.
+type Typed[T any] struct {
+	client Cacher
+	codec  Codec
+	flags  uint32
+}
+
+// NewTyped create a Typed using the codec registered for flags, such as FlagsJSON
+func NewTyped[T any](client Cacher, flags uint32) (*Typed[T], error) {
+	codec, err := lookupCodec(flags)
+	if err != nil {
+		return nil, err
+	}
+	return &Typed[T]{client: client, codec: codec, flags: flags}, nil
+}
+
+// Get retrieve the value of key, the bool result reports whether it's found
+func (typed *Typed[T]) Get(key string) (T, bool, error) {
+	var v T
+	item, err := typed.client.Get(key)
+	if err != nil || item == nil {
+		return v, false, err
+	}
+	if err = typed.codec.Unmarshal(item.Value, &v); err != nil {
+		return v, false, err
+	}
+	return v, true, nil
+}
+
+// Set store v as the value of key, zero ttl means never expire and
+// negative ttl returns ErrInvalidExpiration.
+func (typed *Typed[T]) Set(key string, v T, ttl time.Duration) error {
+	value, err := typed.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return typed.client.Set(&Item{Key: key, Value: value, Flags: typed.flags, TTL: ttl})
+}
+
+// GetMulti retrieve values of keys, missing keys are absent from the result
+func (typed *Typed[T]) GetMulti(keys []string) (map[string]T, error) {
+	items, err := typed.client.MultiGet(keys)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]T, len(items))
+	for _, item := range items {
+		var v T
+		if err = typed.codec.Unmarshal(item.Value, &v); err != nil {
+			return nil, err
+		}
+		results[item.Key] = v
+	}
+	return results, nil
+}
+
+// GetOrLoad retrieve the value of key, on a miss the value is loaded by
+// loader and stored with ttl as Cacher.GetOrLoad does.
+func (typed *Typed[T]) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader func(ctx context.Context) (T, error)) (T, error) {
+	var v T
+	value, err := typed.client.GetOrLoad(ctx, key, ttl, func(ctx context.Context) ([]byte, error) {
+		v, err := loader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return typed.codec.Marshal(v)
+	})
+	if err != nil {
+		return v, err
+	}
+	err = typed.codec.Unmarshal(value, &v)
+	return v, err
+}